@@ -1,8 +1,119 @@
 // wg-allowedips.go - Generate WireGuard AllowedIPs list from config file
 //
 // Usage:
-//   wg-allowedips <allowed-file>                  - Output comma-separated IPs
-//   wg-allowedips <allowed-file> <wg-config>      - Output wg-config with AllowedIPs replaced
+//   wg-allowedips [options] <allowed-file>              - Output comma-separated IPs
+//   wg-allowedips [options] <allowed-file> <wg-config>  - Output wg-config with AllowedIPs replaced
+//   wg-allowedips [options] -csv <file.csv> [wg-config]
+//     Read the entries from the -csv-column column (default "address") of a
+//     CSV file with a header row instead of an allowed file. Empty cells are
+//     skipped.
+//   wg-allowedips [options] expand <entry>              - Print every address one allowed file
+//                                                         entry covers, for debugging
+//
+// Options:
+//   -v                      Verbose output on stderr
+//   -format <format>        Output format for the IP list (default plain):
+//                             plain    comma-separated list
+//                             ios-acl  Cisco IOS ACL permit lines
+//                             netmask  "address netmask" lines for legacy firewalls
+//                             json     addresses with the hostnames they came from
+//                             dot      Graphviz digraph of hostnames to addresses
+//                             wg-set   "wg set" command for -peer on -interface
+//   -state-file <path>      JSON file holding state between runs
+//   -dedupe-warnings        Log a repeated resolution failure only once per
+//                           -warning-cooldown (requires -state-file)
+//   -peer-endpoint <host>   Only rewrite the [Peer] whose Endpoint host matches
+//   -subtract-existing      Output only the entries not already in the
+//                           wg-config's AllowedIPs, as a list
+//   -sample-count <n>       Resolve each hostname n times, -sample-interval
+//                           apart, and use the union of the answers
+//   -validate-dns           Only check that every hostname resolves, reporting
+//                           each failure; exits non-zero if any failed
+//   -inject-into <file>     Replace the lines between "# BEGIN <marker>" and
+//                           "# END <marker>" in file with the list (-marker,
+//                           default wg-allowedips) instead of printing it
+//   -shuffle                Output the list in a random order instead of the
+//                           default sorted order; -seed <n> makes it
+//                           reproducible (0 picks a random seed, shown with -v);
+//                           conflicts with -sort-by weight
+//   -keep-hostnames-alongside
+//                           Also list each resolved hostname next to its
+//                           addresses, for firewalls that resolve names
+//                           themselves (plain or json list output only)
+//   -explain-sort           Print on stderr why each output entry precedes the
+//                           next (debug aid)
+//   -audit-log <file>       Append a JSON line per successful run with input and
+//                           output hashes, resolved and failure counts
+//   -since-last-success     Skip the run without any DNS lookups, replaying the
+//                           last output, if the inputs and options are
+//                           unchanged since a success within -skip-window
+//                           (requires -state-file)
+//   -emit-hosts <file>      Also write /etc/hosts style "IP hostname" lines,
+//                           one per resolved address, to file
+//   -uncomment-allowedips   Fill in a commented-out "#AllowedIPs =" template
+//                           line in peers that have no active AllowedIPs
+//   -record-invocation <f>  Write the tool version and the value of every
+//                           option of a successful run to a JSON file
+//   -progress               Show "done/total resolved" on stderr while
+//                           resolving, when stderr is a terminal
+//   -quiet                  Suppress warnings, verbose output and -progress
+//   -entry-regex <re>       Reject any address, literal or resolved, that does
+//                           not match the regular expression
+//   -offline-fallback       When no DNS server replies, use the last-known-good
+//                           addresses kept in the state file (requires
+//                           -state-file)
+//   -max-distinct-subnets <n>
+//                           Reject a hostname whose addresses span more than n
+//                           distinct networks of -subnet-bits (default /24)
+//   -template-config <f>    Render a wg-config from a Go text/template that can
+//                           use .AllowedIPs, .AllowedIPsList, .Resolved
+//                           (hostname to addresses), .PublicKey (-peer) and
+//                           .Endpoint (-endpoint)
+//   -baseline <file>        Output only the addresses that are not in the
+//                           resolved set of another allowed file
+//   -check-dns-consistency <res1,res2,...>
+//                           Also resolve each hostname against these servers
+//                           and warn when their answers differ; the output
+//                           still comes from the normal resolver
+//   -hostname-denylist <f>  Reject hostnames listed in f, or subdomains of
+//                           them, before any DNS lookup is made
+//   -include-timestamps     Add the lookup time (resolvedAt, RFC3339) to
+//                           resolved addresses in -format json
+//   -offline                Never run DNS lookups; only literal IPs and CIDRs
+//                           are accepted and any hostname is an error
+//   -sort-by weight         Order the output by descending :weight=N of the
+//                           entries (default 0), ties by numeric address;
+//                           the default "address" sorts as plain strings
+//   -compat-check           Fail, naming the entry, if WireGuard would reject
+//                           any entry of the generated AllowedIPs
+//   -use-config-dns         Resolve hostnames through the server on the
+//                           wg-config's [Interface] DNS line, as the tunnel would
+//   -fail-threshold <f>     Fail if more than fraction f (0-1) of hostnames fail
+//                           to resolve; below it they are only warnings (default 1)
+//   -watch-dns <interval>   Apply the list to -peer on -interface with "wg set",
+//                           then re-resolve every interval and re-apply it when
+//                           the resolved set changes, logging each change
+//   -max-runtime <d>        Abort, writing no output at all, if the whole run takes
+//                           longer than d (e.g. 60s); exits with status 124
+//   -wrap <n>               Wrap the plain list at column n with indented
+//                           continuation lines; in a wg-config, write as many
+//                           AllowedIPs lines as needed to stay within n columns
+//   -diff-config            Print a unified diff from the wg-config to its rewrite
+//                           instead of the rewritten config, exiting 1 if they differ
+//   -group-by-host          Group -format json addresses under each hostname they
+//                           were resolved from (sorted), then the literal ones in a
+//                           "static" group; a shared address is under every hostname
+//   -refresh-after          Add refreshAfter to -format json: the seconds until the
+//                           first record looked up expires (its TTL), suggesting
+//                           when to re-run
+//   -min-refresh <d>        Never suggest a refreshAfter below d (default 1m)
+//   -only-grow              Refuse to rewrite a wg-config, naming the addresses,
+//                           if the new AllowedIPs would drop any existing one
+//
+//   wg-allowedips [options] -fleet <fleet.json>
+//     Generate several tunnels in one run. The fleet file lists tunnels as
+//     {"tunnels": [{"name", "allowedFile", "wgConfig", "peerEndpoint", "output"}]}
+//     and each rewritten wg-config is written to its output path.
 //
 // Allowed file format:
 //   # This is a comment
@@ -10,18 +121,43 @@
 //   192.168.1.0/24
 //   192.168.1.0
 //   example.com
+//   service.example.com TXT   (IPs/CIDRs listed in the TXT record, comma-separated)
+//   example.com MX            (addresses of the domain's mail exchanges)
+//   app.example.com:8000-8100 (port or port range, documentation only)
+//   internal.example.com @10.0.0.53
+//                             (resolved by that DNS server instead of the default)
+//   primary.example.com :weight=10
+//                             (priority for -sort-by weight; only affects the
+//                             order of the output, never its contents)
 
 package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
+	"net/netip"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 )
 
 const (
@@ -30,15 +166,129 @@ const (
 	colorReset  = "\033[0m"
 )
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+var (
+	outputFormat        = flag.String("format", "plain", "Output format for the IP list: plain, ios-acl, netmask, json, dot, wg-set")
+	stateFile           = flag.String("state-file", "", "JSON file holding state between runs")
+	dedupeWarnings      = flag.Bool("dedupe-warnings", false, "Log a repeated resolution failure only once per -warning-cooldown (requires -state-file)")
+	warningCooldown     = flag.Duration("warning-cooldown", 24*time.Hour, "How long a logged resolution failure stays silent with -dedupe-warnings")
+	verbose             = flag.Bool("v", false, "Verbose output on stderr")
+	peerEndpoint        = flag.String("peer-endpoint", "", "Only rewrite AllowedIPs of the [Peer] whose Endpoint host matches")
+	subtractExisting    = flag.Bool("subtract-existing", false, "Output only the entries not already in the wg-config's AllowedIPs, as a list")
+	fleetFile           = flag.String("fleet", "", "JSON file describing several tunnels to generate in one run")
+	concurrency         = flag.Int("concurrency", 4, "Number of -fleet tunnels processed at once")
+	sampleCount         = flag.Int("sample-count", 1, "Resolve each hostname this many times and use the union of the answers")
+	sampleInterval      = flag.Duration("sample-interval", time.Second, "Delay between -sample-count lookups")
+	peerKey             = flag.String("peer", "", "Peer public key for -format wg-set")
+	wgInterface         = flag.String("interface", "", "WireGuard interface for -format wg-set")
+	validateDNS         = flag.Bool("validate-dns", false, "Only check that every hostname resolves, reporting each failure; no output")
+	injectFile          = flag.String("inject-into", "", "Replace the marked block of this file with the list instead of printing it")
+	injectMarker        = flag.String("marker", "wg-allowedips", "Marker name of the -inject-into block (# BEGIN <marker> / # END <marker>)")
+	shuffle             = flag.Bool("shuffle", false, "Output the list in a random order instead of sorted")
+	shuffleSeed         = flag.Int64("seed", 0, "Seed for -shuffle; 0 picks a random seed, shown with -v")
+	keepHostnames       = flag.Bool("keep-hostnames-alongside", false, "Also list each resolved hostname itself next to its addresses (plain or json list output only)")
+	explainSort         = flag.Bool("explain-sort", false, "Print on stderr why each output entry precedes the next")
+	csvFile             = flag.String("csv", "", "Read entries from a CSV file instead of an allowed file")
+	csvColumnName       = flag.String("csv-column", "address", "Column of the -csv file holding the entries")
+	auditLog            = flag.String("audit-log", "", "Append a JSON record of each successful run to this file")
+	sinceLastSuccess    = flag.Bool("since-last-success", false, "Skip the run, replaying the last output, if the inputs are unchanged since the last success within -skip-window (requires -state-file)")
+	skipWindow          = flag.Duration("skip-window", time.Hour, "How recent the last success must be for -since-last-success to skip")
+	emitHosts           = flag.String("emit-hosts", "", "Also write \"IP hostname\" lines for every resolved hostname to this file")
+	uncommentAllowedIPs = flag.Bool("uncomment-allowedips", false, "Fill in a commented-out AllowedIPs line in peers that have no active one")
+	recordInvocation    = flag.String("record-invocation", "", "Write the version and every option value of a successful run to this JSON file")
+	quiet               = flag.Bool("quiet", false, "Suppress warnings, verbose output and the progress display")
+	showProgress        = flag.Bool("progress", false, "Show resolution progress on stderr when it is a terminal")
+	entryRegex          = flag.String("entry-regex", "", "Reject any address, literal or resolved, that does not match this regular expression")
+	offlineFallback     = flag.Bool("offline-fallback", false, "Use the last-known-good addresses from the state file when the DNS resolver is unreachable")
+	maxSubnets          = flag.Int("max-distinct-subnets", 0, "Reject a hostname whose addresses span more than this many -subnet-bits networks (0 disables)")
+	subnetBits          = flag.Int("subnet-bits", 24, "Prefix length of the networks counted by -max-distinct-subnets")
+	templateConfig      = flag.String("template-config", "", "Render a whole wg-config from this text/template file instead of rewriting one")
+	endpoint            = flag.String("endpoint", "", "Peer endpoint made available to -template-config")
+	baselineFile        = flag.String("baseline", "", "Output only the addresses not in this allowed file's resolved set")
+	dnsConsistency      = flag.String("check-dns-consistency", "", "Comma-separated resolvers to compare each hostname's answers across, warning on disagreement")
+	hostnameDenylist    = flag.String("hostname-denylist", "", "File of hostnames that, with their subdomains, are rejected before any lookup")
+	includeTimestamps   = flag.Bool("include-timestamps", false, "Add resolvedAt (RFC3339) to resolved addresses in -format json")
+	offline             = flag.Bool("offline", false, "Never touch the network: only literal IPs and CIDRs are accepted, hostnames are errors")
+	sortBy              = flag.String("sort-by", "address", "Output order: address, or weight (descending :weight=N, then numeric address)")
+	compatCheck         = flag.Bool("compat-check", false, "Fail if any output entry is not an IP or CIDR that WireGuard would accept")
+	useConfigDNS        = flag.Bool("use-config-dns", false, "Resolve hostnames through the DNS server of the wg-config's [Interface]")
+	failThreshold       = flag.Float64("fail-threshold", 1, "Fail if more than this fraction of hostnames fail to resolve")
+	watchInterval       = flag.Duration("watch-dns", 0, "Re-resolve every interval and re-apply to -interface when the set changes")
+	maxRuntime          = flag.Duration("max-runtime", 0, "Abort without writing any output if the run takes longer than this")
+	wrapWidth           = flag.Int("wrap", 0, "Wrap the plain list at this column, or split AllowedIPs into lines that fit it")
+	diffConfig          = flag.Bool("diff-config", false, "Print a unified diff of the wg-config rewrite instead of the result; exit 1 if it changes")
+	groupByHost         = flag.Bool("group-by-host", false, "Group -format json addresses under the hostnames they came from")
+	refreshAfter        = flag.Bool("refresh-after", false, "Add refreshAfter, the lowest TTL of the records looked up, to -format json")
+	minRefresh          = flag.Duration("min-refresh", time.Minute, "Lowest refreshAfter suggested by -refresh-after")
+	onlyGrow            = flag.Bool("only-grow", false, "Refuse to rewrite a wg-config if that would remove any of its AllowedIPs")
+)
+
 func errorExit(format string, args ...interface{}) {
+	staged.rollback()
+	progress.clear()
 	fmt.Fprintf(os.Stderr, colorRed+"ERROR: "+format+colorReset+"\n", args...)
 	os.Exit(1)
 }
 
 func warn(format string, args ...interface{}) {
+	if *quiet {
+		return
+	}
+	progress.clear()
 	fmt.Fprintf(os.Stderr, colorYellow+"WARNING: "+format+colorReset+"\n", args...)
 }
 
+// progress shows how many hostnames have been resolved with -progress
+var progress = &progressMeter{}
+
+// progressMeter renders "done/total resolved" in place on stderr
+type progressMeter struct {
+	mu      sync.Mutex
+	enabled bool
+	done    int
+	total   int
+}
+
+func (p *progressMeter) addTotal(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total += n
+}
+
+// step counts one resolved hostname and redraws the meter
+func (p *progressMeter) step() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if p.enabled {
+		fmt.Fprintf(os.Stderr, "\r\033[K%d/%d resolved", p.done, p.total)
+	}
+}
+
+// clear erases the meter so other output starts on a clean line
+func (p *progressMeter) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.enabled && p.done > 0 {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+}
+
+// isTerminal reports whether f is a character device such as a TTY
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func verbosef(format string, args ...interface{}) {
+	if *verbose && !*quiet {
+		progress.clear()
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+}
+
 // isValidIPv4 checks if the string is a valid IPv4 address
 func isValidIPv4(s string) bool {
 	ip := net.ParseIP(s)
@@ -96,10 +346,97 @@ func isValidHostname(s string) bool {
 	return true
 }
 
-// resolveHostname uses dig to resolve a hostname to IPv4 addresses
-func resolveHostname(hostname string) ([]string, error) {
-	cmd := exec.Command("dig", "+short", hostname)
-	output, err := cmd.Output()
+// defaultServer is the DNS server lookups use when none is given, empty for
+// the system resolver
+var defaultServer string
+
+// runDig runs the dig binary with args and returns its standard output. It is
+// the only place lookups touch the network, so a fake resolver can replace it
+var runDig = func(args ...string) ([]byte, error) {
+	return exec.Command("dig", args...).Output()
+}
+
+// dig runs "dig +short" with the given query arguments, asking server if it
+// is set and defaultServer otherwise. With -refresh-after it reads the full
+// answer section instead, noting the TTLs, and returns it as +short would.
+func dig(server string, query ...string) ([]byte, error) {
+	if *offline {
+		return nil, errors.New("network access is disabled by -offline")
+	}
+	if server == "" {
+		server = defaultServer
+	}
+	args := []string{"+short"}
+	if *refreshAfter {
+		args = []string{"+noall", "+answer"}
+	}
+	if server != "" {
+		args = append(args, "@"+server)
+	}
+	output, err := runDig(append(args, query...)...)
+	if err != nil || !*refreshAfter {
+		return output, err
+	}
+	return answerData(output), nil
+}
+
+// minTTL is the lowest TTL of any record looked up this run, for
+// -refresh-after; zero until one is seen
+var minTTL = &ttlTracker{}
+
+// ttlTracker is a concurrency-safe minimum of TTLs in seconds
+type ttlTracker struct {
+	mu   sync.Mutex
+	ttl  int
+	seen bool
+}
+
+func (t *ttlTracker) observe(ttl int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.seen || ttl < t.ttl {
+		t.ttl, t.seen = ttl, true
+	}
+}
+
+func (t *ttlTracker) min() (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ttl, t.seen
+}
+
+// answerData turns dig's answer section ("name TTL class type data" lines)
+// into the data lines "dig +short" prints, recording each TTL in minTTL
+func answerData(output []byte) []byte {
+	var data bytes.Buffer
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		ttl, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		minTTL.observe(ttl)
+		// Cut the four leading fields off the line rather than rejoining the
+		// rest, which would collapse spaces inside quoted TXT strings
+		rest := line
+		for i := 0; i < 4; i++ {
+			rest = strings.TrimLeft(rest[strings.IndexAny(rest, " \t"):], " \t")
+		}
+		data.WriteString(rest + "\n")
+	}
+	return data.Bytes()
+}
+
+// resolveHostname uses dig to resolve a hostname to IPv4 addresses, asking
+// server if it is set
+func resolveHostname(hostname, server string) ([]string, error) {
+	output, err := dig(server, hostname)
 	if err != nil {
 		return nil, err
 	}
@@ -119,118 +456,2806 @@ func resolveHostname(hostname string) ([]string, error) {
 	return ips, nil
 }
 
-// removeDuplicates removes duplicate strings from a slice
-func removeDuplicates(slice []string) []string {
-	seen := make(map[string]bool)
-	result := []string{}
-	for _, item := range slice {
-		if !seen[item] {
-			seen[item] = true
-			result = append(result, item)
+// entry is one address contributed to the AllowedIPs set
+type entry struct {
+	value  string // IPv4 address or CIDR
+	source string // hostname the address was resolved from, empty for literals
+	record string // record type it was resolved via: "" for A, "TXT" or "MX"
+	line   int    // line number in the allowed file
+	weight int    // output priority with -sort-by weight
+
+	resolvedAt time.Time // when the lookup was made, zero for literals
+}
+
+// parseAllowed reads allowed file entries, resolving hostnames as it goes
+func parseAllowed(r io.Reader, failures *failureLog) ([]entry, error) {
+	lines, err := readAllowedLines(r)
+	if err != nil {
+		return nil, err
+	}
+	return parseLines(lines, failures)
+}
+
+// readAllowedLines reads the raw lines of an allowed file
+func readAllowedLines(r io.Reader) ([]sourceLine, error) {
+	var lines []sourceLine
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		lines = append(lines, sourceLine{scanner.Text(), lineNum})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading config file: %v", err)
+	}
+	return lines, nil
+}
+
+// screenAllowedFiles runs the first pass of parseLines over every allowed
+// file a run will read, so that a denylisted hostname (or any with -offline)
+// in one of them stops the run before anything is resolved
+func screenAllowedFiles(paths ...string) error {
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("Config file does not exist: %s", path)
+		}
+		lines, err := readAllowedLines(file)
+		file.Close()
+		if err == nil {
+			_, err = screenHostnames(lines)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
 		}
 	}
-	return result
+	return nil
 }
 
-func usage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s <allowed-file> [wg-config]\n", os.Args[0])
-	os.Exit(1)
+// parseCSV reads entries from the named column of a CSV file with a header
+// row, skipping empty cells
+func parseCSV(r io.Reader, column string, failures *failureLog) ([]entry, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CSV header: %v", err)
+	}
+	index := -1
+	for i, name := range header {
+		if strings.TrimSpace(name) == column {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("CSV has no column named %s", column)
+	}
+
+	var lines []sourceLine
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CSV: %v", err)
+		}
+		lineNum, _ := reader.FieldPos(index)
+		lines = append(lines, sourceLine{record[index], lineNum})
+	}
+	return parseLines(lines, failures)
 }
 
-func main() {
-	if len(os.Args) < 2 || len(os.Args) > 3 {
-		usage()
+// sourceLine is one raw entry with the line number it was read from
+type sourceLine struct {
+	text string
+	num  int
+}
+
+// parseLines parses and resolves raw entries. A first pass counts their
+// hostnames towards the -progress total and rejects denylisted ones (or all
+// of them with -offline), so nothing is resolved if any hostname is refused.
+func parseLines(lines []sourceLine, failures *failureLog) ([]entry, error) {
+	hostnames, err := screenHostnames(lines)
+	if err != nil {
+		return nil, err
 	}
+	progress.addTotal(hostnames)
+	failures.expect(hostnames)
 
-	configFile := os.Args[1]
-	var wgConfigFile string
-	if len(os.Args) == 3 {
-		wgConfigFile = os.Args[2]
+	var entries []entry
+	for _, line := range lines {
+		lineEntries, err := parseEntry(line.text, line.num, failures)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, lineEntries...)
+	}
+	return entries, nil
+}
+
+// screenHostnames counts the hostnames among lines, failing on the first one
+// that is denylisted, or on any with -offline
+func screenHostnames(lines []sourceLine) (int, error) {
+	hostnames := 0
+	for _, line := range lines {
+		fields := strings.Fields(line.text)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		value, err := stripPortRange(fields[0])
+		if err != nil || isValidIPv4(value) || isValidIPv4CIDR(value) || !isValidHostname(value) {
+			continue
+		}
+		if denied := deniedBy(value); denied != "" {
+			return 0, fmt.Errorf("Line %d: Hostname %s is denied by -hostname-denylist entry %s", line.num, value, denied)
+		}
+		if *offline {
+			return 0, fmt.Errorf("Line %d: Hostname %s cannot be resolved with -offline", line.num, value)
+		}
+		hostnames++
+	}
+	return hostnames, nil
+}
+
+// parseEntry validates one allowed file line, resolving it if it is a hostname
+func parseEntry(line string, lineNum int, failures *failureLog) ([]entry, error) {
+	line = strings.TrimSpace(line)
+
+	// Skip empty lines
+	if line == "" {
+		return nil, nil
+	}
+
+	// Skip comments
+	if strings.HasPrefix(line, "#") {
+		return nil, nil
 	}
 
-	// Open config file
-	file, err := os.Open(configFile)
+	// A hostname may be followed by options, e.g. "example.com TXT"
+	fields := strings.Fields(line)
+	value, err := stripPortRange(fields[0])
 	if err != nil {
-		errorExit("Config file does not exist: %s", configFile)
+		return nil, fmt.Errorf("Line %d: %v", lineNum, err)
+	}
+	opts, err := parseLineOptions(fields[1:])
+	if err != nil {
+		return nil, fmt.Errorf("Line %d: %v", lineNum, err)
 	}
-	defer file.Close()
 
-	var allIPs []string
-	scanner := bufio.NewScanner(file)
-	lineNum := 0
+	var entries []entry
+	if isValidIPv4(value) || isValidIPv4CIDR(value) {
+		if opts.hostnameOnly() {
+			return nil, fmt.Errorf("Line %d: Options are only allowed after a hostname: %s", lineNum, line)
+		}
+		entries = append(entries, entry{value: value, line: lineNum, weight: opts.weight})
+	} else if isValidHostname(value) {
+		// Resolve hostname
+		resolvedIPs, err := resolveEntry(value, opts, failures)
+		progress.step()
+		resolvedAt := lookupCache.resolvedAt(lookupKey(value, opts))
+		if *offlineFallback && err == nil && len(resolvedIPs) > 0 {
+			knownGood.remember(lookupKey(value, opts), knownAnswer{IPs: resolvedIPs, ResolvedAt: resolvedAt})
+		}
+		if err != nil && *offlineFallback && resolverUnreachable(err) {
+			if cached, ok := knownGood.recall(lookupKey(value, opts)); ok {
+				warn("Line %d: DNS resolver unreachable, using last-known-good addresses for %s", lineNum, value)
+				// The addresses are as old as the lookup that cached them
+				resolvedIPs, err, resolvedAt = cached.IPs, nil, cached.ResolvedAt
+			}
+		}
+		if err != nil {
+			failures.warn("resolve:"+value, "Line %d: Failed to resolve hostname %s: %v", lineNum, value, err)
+			return nil, nil
+		}
+		if len(resolvedIPs) == 0 && opts.recordType == "MX" {
+			failures.warn("empty:"+value, "Line %d: No MX records for domain: %s", lineNum, value)
+		} else if len(resolvedIPs) == 0 {
+			failures.warn("empty:"+value, "Line %d: No DNS results for hostname: %s", lineNum, value)
+		}
+		resolvedTotal.Add(int64(len(resolvedIPs)))
+		for _, ip := range resolvedIPs {
+			// TXT records carry free-form text, so validate it like a literal entry
+			if !isValidIPv4(ip) && !isValidIPv4CIDR(ip) {
+				return nil, fmt.Errorf("Line %d: Invalid entry in %s record of %s: %s", lineNum, opts.recordType, value, ip)
+			}
+			entries = append(entries, entry{value: ip, source: value, record: opts.recordType, line: lineNum, weight: opts.weight, resolvedAt: resolvedAt})
+		}
+		if len(consistencyResolvers) > 0 && opts.recordType == "" {
+			checkConsistency(value, lineNum)
+		}
+		if *maxSubnets > 0 {
+			if n := distinctSubnets(resolvedIPs, *subnetBits); n > *maxSubnets {
+				return nil, fmt.Errorf("Line %d: %s resolves into %d distinct /%d networks, more than -max-distinct-subnets %d", lineNum, value, n, *subnetBits, *maxSubnets)
+			}
+		}
+		if *keepHostnames && opts.recordType == "" && len(resolvedIPs) > 0 {
+			entries = append(entries, entry{value: value, source: value, line: lineNum, weight: opts.weight})
+		}
+	} else {
+		return nil, fmt.Errorf("Line %d: Invalid entry (not an IPv4 or hostname): %s", lineNum, line)
+	}
 
-	for scanner.Scan() {
-		lineNum++
-		line := strings.TrimSpace(scanner.Text())
+	if entryPattern != nil {
+		for _, e := range entries {
+			if e.value == e.source || entryPattern.MatchString(e.value) {
+				continue
+			}
+			if e.source != "" {
+				return nil, fmt.Errorf("Line %d: %s (resolved from %s) does not match -entry-regex %s", lineNum, e.value, e.source, entryPattern)
+			}
+			return nil, fmt.Errorf("Line %d: %s does not match -entry-regex %s", lineNum, e.value, entryPattern)
+		}
+	}
+	return entries, nil
+}
 
-		// Skip empty lines
-		if line == "" {
+// deniedHostnames are the -hostname-denylist entries, lowercased
+var deniedHostnames []string
+
+// loadDenylist reads one hostname per line, skipping blanks and comments
+func loadDenylist(path string) ([]string, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
+		name := strings.ToLower(strings.TrimSuffix(line, "."))
+		if !isValidHostname(name) {
+			return nil, fmt.Errorf("line %d: invalid hostname: %s", i+1, line)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// deniedBy returns the denylist entry that hostname equals or is a
+// subdomain of, or "" if it is allowed
+func deniedBy(hostname string) string {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	for _, denied := range deniedHostnames {
+		if hostname == denied || strings.HasSuffix(hostname, "."+denied) {
+			return denied
+		}
+	}
+	return ""
+}
+
+// consistencyResolvers are the servers compared by -check-dns-consistency
+var consistencyResolvers []string
 
-		// Skip comments
-		if strings.HasPrefix(line, "#") {
+// checkConsistency resolves hostname against every -check-dns-consistency
+// server and warns, listing each server's answer, if they disagree
+func checkConsistency(hostname string, lineNum int) {
+	answers := make([]string, len(consistencyResolvers))
+	for i, server := range consistencyResolvers {
+		ips, err := lookupCache.lookup("@"+server+" "+hostname, func() ([]string, error) {
+			return resolveHostname(hostname, server)
+		})
+		if err != nil {
+			answers[i] = "error: " + err.Error()
 			continue
 		}
+		ips = slices.Clone(ips)
+		sort.Strings(ips)
+		answers[i] = strings.Join(removeDuplicates(ips), ",")
+	}
+
+	for _, answer := range answers[1:] {
+		if answer != answers[0] {
+			parts := make([]string, len(answers))
+			for i, server := range consistencyResolvers {
+				parts[i] = fmt.Sprintf("%s: [%s]", server, answers[i])
+			}
+			warn("Line %d: Resolvers disagree on %s: %s", lineNum, hostname, strings.Join(parts, "; "))
+			return
+		}
+	}
+}
+
+// distinctSubnets counts the distinct /bits networks that addresses fall in
+func distinctSubnets(addresses []string, bits int) int {
+	mask := net.CIDRMask(bits, 32)
+	networks := make(map[string]bool)
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			if _, ipnet, err := net.ParseCIDR(address); err == nil {
+				ip = ipnet.IP
+			}
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			networks[ip4.Mask(mask).String()] = true
+		}
+	}
+	return len(networks)
+}
+
+// entryPattern is the compiled -entry-regex, nil if unset
+var entryPattern *regexp.Regexp
 
-		if isValidIPv4(line) {
-			allIPs = append(allIPs, line)
-		} else if isValidIPv4CIDR(line) {
-			allIPs = append(allIPs, line)
-		} else if isValidHostname(line) {
-			// Resolve hostname
-			resolvedIPs, err := resolveHostname(line)
+// stripPortRange removes a ":port" or ":low-high" suffix that documents a
+// hostname's service ports; it does not affect the AllowedIPs
+func stripPortRange(value string) (string, error) {
+	host, ports, ok := strings.Cut(value, ":")
+	if !ok || !isValidHostname(host) {
+		return value, nil
+	}
+	low, high, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		high = low
+	}
+	lowPort, err1 := strconv.Atoi(low)
+	highPort, err2 := strconv.Atoi(high)
+	if err1 != nil || err2 != nil || lowPort < 1 || highPort > 65535 || lowPort > highPort {
+		return "", fmt.Errorf("Invalid port range for %s: %s", host, ports)
+	}
+	return host, nil
+}
+
+// lineOptions are the modifiers that may follow a hostname in the allowed file
+type lineOptions struct {
+	recordType string // "TXT" to read IPs from a TXT record, "MX" to resolve the mail exchanges
+	weight     int    // ":weight=N", orders the output with -sort-by weight
+	server     string // "@server", the DNS server to ask instead of the default
+}
+
+// hostnameOnly reports whether opts use options that only apply to hostnames
+func (opts lineOptions) hostnameOnly() bool {
+	return opts.recordType != "" || opts.server != ""
+}
+
+// parseLineOptions parses the fields following an entry
+func parseLineOptions(fields []string) (lineOptions, error) {
+	var opts lineOptions
+	for _, field := range fields {
+		switch {
+		case strings.EqualFold(field, "TXT"):
+			opts.recordType = "TXT"
+		case strings.EqualFold(field, "MX"):
+			opts.recordType = "MX"
+		case strings.HasPrefix(field, ":weight="):
+			weight, err := strconv.Atoi(strings.TrimPrefix(field, ":weight="))
 			if err != nil {
-				warn("Line %d: Failed to resolve hostname %s: %v", lineNum, line, err)
-				continue
+				return opts, fmt.Errorf("Invalid weight: %s", field)
 			}
-			if len(resolvedIPs) == 0 {
-				warn("Line %d: No DNS results for hostname: %s", lineNum, line)
-			} else {
-				allIPs = append(allIPs, resolvedIPs...)
+			opts.weight = weight
+		case strings.HasPrefix(field, "@"):
+			server := strings.TrimPrefix(field, "@")
+			if net.ParseIP(server) == nil && !isValidHostname(server) {
+				return opts, fmt.Errorf("Invalid DNS server: %s", field)
 			}
-		} else {
-			errorExit("Line %d: Invalid entry (not an IPv4 or hostname): %s", lineNum, line)
+			opts.server = server
+		default:
+			return opts, fmt.Errorf("Unknown option: %s", field)
 		}
 	}
+	return opts, nil
+}
 
-	if err := scanner.Err(); err != nil {
-		errorExit("Error reading config file: %v", err)
+// lookupKey identifies the lookup a hostname line performs, for caching
+func lookupKey(hostname string, opts lineOptions) string {
+	key := hostname
+	if opts.recordType != "" {
+		key = opts.recordType + " " + key
+	}
+	if opts.server != "" {
+		key = "@" + opts.server + " " + key
+	}
+	return key
+}
+
+// knownGood keeps the last successful answer of every lookup in the state
+// file, for -offline-fallback
+var knownGood = &answerStore{answers: make(map[string]knownAnswer)}
+
+// knownAnswer is a successful answer and when it was looked up
+type knownAnswer struct {
+	IPs        []string  `json:"ips"`
+	ResolvedAt time.Time `json:"resolvedAt"`
+}
+
+// UnmarshalJSON also accepts the bare address list that state files written
+// before answers carried their lookup time hold
+func (k *knownAnswer) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		*k = knownAnswer{}
+		return json.Unmarshal(data, &k.IPs)
 	}
+	type plain knownAnswer
+	return json.Unmarshal(data, (*plain)(k))
+}
 
-	// Remove duplicates and sort
-	allIPs = removeDuplicates(allIPs)
-	sort.Strings(allIPs)
+// answerStore is a concurrency-safe map of lookup key to answer
+type answerStore struct {
+	mu      sync.Mutex
+	answers map[string]knownAnswer
+}
 
-	allowedIPsValue := strings.Join(allIPs, ",")
+func (a *answerStore) remember(key string, answer knownAnswer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.answers[key] = answer
+}
 
-	// Output mode depends on whether wg-config was provided
-	if wgConfigFile == "" {
-		// Just output comma-separated list
-		if len(allIPs) > 0 {
-			fmt.Println(allowedIPsValue)
+func (a *answerStore) recall(key string) (knownAnswer, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	answer, ok := a.answers[key]
+	return answer, ok
+}
+
+// resolverUnreachable reports whether dig failed because no DNS server
+// replied at all (exit status 9), as opposed to the name not resolving
+func resolverUnreachable(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == 9
+}
+
+// resolveEntry resolves a hostname from the allowed file according to its options
+func resolveEntry(hostname string, opts lineOptions, failures *failureLog) ([]string, error) {
+	return lookupCache.lookup(lookupKey(hostname, opts), func() ([]string, error) {
+		switch opts.recordType {
+		case "TXT":
+			return resolveTXT(hostname, opts.server)
+		case "MX":
+			return resolveMX(hostname, opts.server, failures)
 		}
-	} else {
-		// Read and output wg-config with AllowedIPs replaced
-		wgFile, err := os.Open(wgConfigFile)
-		if err != nil {
-			errorExit("WireGuard config file does not exist: %s", wgConfigFile)
+		return sampleHostname(hostname, opts.server)
+	})
+}
+
+// entryValues returns the address of every entry
+func entryValues(entries []entry) []string {
+	values := make([]string, len(entries))
+	for i, e := range entries {
+		values[i] = e.value
+	}
+	return values
+}
+
+// maskHostBits rewrites CIDRs with host bits set (10.0.0.5/24) to their
+// network address (10.0.0.0/24) so that variants of the same network dedup,
+// warning once about all the variants that were masked
+func maskHostBits(entries []entry) []entry {
+	variants := make(map[string][]string)
+	var networks []string
+	for i, e := range entries {
+		if !strings.Contains(e.value, "/") {
+			continue
 		}
-		defer wgFile.Close()
+		_, ipnet, err := net.ParseCIDR(e.value)
+		if err != nil || ipnet.String() == e.value {
+			continue
+		}
+		network := ipnet.String()
+		if variants[network] == nil {
+			networks = append(networks, network)
+		}
+		if !slices.Contains(variants[network], e.value) {
+			variants[network] = append(variants[network], e.value)
+		}
+		entries[i].value = network
+	}
+	if len(networks) == 0 {
+		return entries
+	}
 
-		wgScanner := bufio.NewScanner(wgFile)
-		for wgScanner.Scan() {
-			line := wgScanner.Text()
-			trimmed := strings.TrimSpace(line)
-			if strings.HasPrefix(trimmed, "AllowedIPs") {
-				fmt.Printf("AllowedIPs = %s\n", allowedIPsValue)
-			} else {
-				fmt.Println(line)
-			}
+	sort.Strings(networks)
+	parts := make([]string, len(networks))
+	for i, network := range networks {
+		parts[i] = fmt.Sprintf("%s -> %s", strings.Join(variants[network], ", "), network)
+	}
+	warn("CIDRs with host bits set were masked: %s", strings.Join(parts, "; "))
+	return entries
+}
+
+// noteCovered notes in verbose output each resolved address that a CIDR
+// listed in the allowed file already covers, with the narrowest such CIDR.
+// The addresses themselves stay in the output.
+func noteCovered(entries []entry) {
+	type listedCIDR struct {
+		text  string
+		ipnet *net.IPNet
+	}
+	var cidrs []listedCIDR
+	for _, e := range entries {
+		if e.source != "" || !strings.Contains(e.value, "/") {
+			continue
+		}
+		if _, ipnet, err := net.ParseCIDR(e.value); err == nil {
+			cidrs = append(cidrs, listedCIDR{e.value, ipnet})
 		}
+	}
+	if len(cidrs) == 0 {
+		return
+	}
 
-		if err := wgScanner.Err(); err != nil {
-			errorExit("Error reading WireGuard config file: %v", err)
+	for _, e := range entries {
+		ip := net.ParseIP(e.value)
+		if e.source == "" || ip == nil {
+			continue
+		}
+		var narrowest *listedCIDR
+		for i, c := range cidrs {
+			if !c.ipnet.Contains(ip) {
+				continue
+			}
+			ones, _ := c.ipnet.Mask.Size()
+			if narrowest == nil {
+				narrowest = &cidrs[i]
+			} else if best, _ := narrowest.ipnet.Mask.Size(); ones > best {
+				narrowest = &cidrs[i]
+			}
+		}
+		if narrowest != nil {
+			verbosef("%s (from %s) covered by %s", e.value, e.source, narrowest.text)
 		}
 	}
 }
+
+// lookupCache memoizes resolutions so a hostname is only resolved once per
+// run, even when it appears in several files of a fleet
+var lookupCache = &resolveCache{entries: make(map[string]*cachedLookup)}
+
+// resolveCache is a concurrency-safe memo of lookup results by key
+type resolveCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedLookup
+}
+
+type cachedLookup struct {
+	once sync.Once
+	ips  []string
+	err  error
+	at   time.Time // when the lookup was made
+}
+
+// lookup returns the cached result for key, calling fn on first use
+func (c *resolveCache) lookup(key string, fn func() ([]string, error)) ([]string, error) {
+	c.mu.Lock()
+	cached, ok := c.entries[key]
+	if !ok {
+		cached = &cachedLookup{}
+		c.entries[key] = cached
+	}
+	c.mu.Unlock()
+
+	cached.once.Do(func() {
+		cached.at = time.Now()
+		cached.ips, cached.err = fn()
+	})
+	return cached.ips, cached.err
+}
+
+// resolvedAt returns when the lookup for key was made, zero if it was not
+func (c *resolveCache) resolvedAt(key string) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.entries[key]; ok {
+		return cached.at
+	}
+	return time.Time{}
+}
+
+// resolveTXT uses dig to fetch a hostname's TXT records and splits their
+// contents into comma- or space-separated entries, asking server if it is set
+func resolveTXT(hostname, server string) ([]string, error) {
+	output, err := dig(server, "TXT", hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []string
+	for _, line := range strings.Split(string(output), "\n") {
+		// A record may consist of several quoted strings, which are concatenated
+		text := strings.ReplaceAll(strings.TrimSpace(line), `" "`, "")
+		text = strings.Trim(text, `"`)
+		entries = append(entries, strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == ' ' })...)
+	}
+	return entries, nil
+}
+
+// mxRecord is one mail exchange of a domain
+type mxRecord struct {
+	preference int
+	host       string
+}
+
+// resolveMX uses dig to look up a domain's MX records and resolves each mail
+// exchange to its IPv4 addresses, in order of MX preference, asking server if
+// it is set. Mail exchanges that fail to resolve are logged to failures.
+func resolveMX(domain, server string, failures *failureLog) ([]string, error) {
+	output, err := dig(server, "MX", domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []mxRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		preference, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		records = append(records, mxRecord{preference, strings.TrimSuffix(fields[1], ".")})
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].preference < records[j].preference })
+
+	// Each mail exchange is a hostname lookup of its own for -fail-threshold
+	failures.expect(len(records))
+	var ips []string
+	for _, mx := range records {
+		// The exchange comes from DNS data and is passed to dig, so it must
+		// not be able to pose as one of dig's options
+		if !isValidHostname(mx.host) {
+			failures.warn("mx:"+mx.host, "Invalid mail exchange %q of %s", mx.host, domain)
+			continue
+		}
+		mxIPs, err := lookupCache.lookup(lookupKey(mx.host, lineOptions{server: server}), func() ([]string, error) {
+			return sampleHostname(mx.host, server)
+		})
+		if err != nil {
+			failures.warn("mx:"+mx.host, "Failed to resolve mail exchange %s of %s: %v", mx.host, domain, err)
+			continue
+		}
+		verbosef("MX %s: %d %s -> %s", domain, mx.preference, mx.host, strings.Join(mxIPs, ","))
+		ips = append(ips, mxIPs...)
+	}
+	if len(records) > 0 && len(ips) == 0 {
+		return nil, fmt.Errorf("none of its %d mail exchange(s) resolved", len(records))
+	}
+	return ips, nil
+}
+
+// sampleHostname resolves a hostname -sample-count times, -sample-interval
+// apart, and returns the union so rotating round-robin answers are all
+// captured. It only fails if every sample failed. It asks server if it is set.
+func sampleHostname(hostname, server string) ([]string, error) {
+	var ips []string
+	var lastErr error
+	succeeded := false
+	for i := 0; i < max(*sampleCount, 1); i++ {
+		if i > 0 {
+			time.Sleep(*sampleInterval)
+		}
+		sample, err := resolveHostname(hostname, server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		succeeded = true
+		ips = append(ips, sample...)
+	}
+	if !succeeded {
+		return nil, lastErr
+	}
+	return removeDuplicates(ips), nil
+}
+
+// countBySource summarizes how many distinct addresses each hostname or
+// literal entry contributed, largest first
+func countBySource(entries []entry) string {
+	addresses := make(map[string]map[string]bool)
+	for _, e := range entries {
+		source := e.source
+		if source == e.value {
+			// A hostname kept alongside its addresses
+			continue
+		}
+		if source == "" {
+			source = e.value
+		}
+		if addresses[source] == nil {
+			addresses[source] = make(map[string]bool)
+		}
+		addresses[source][e.value] = true
+	}
+
+	sources := make([]string, 0, len(addresses))
+	for source := range addresses {
+		sources = append(sources, source)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		ci, cj := len(addresses[sources[i]]), len(addresses[sources[j]])
+		if ci != cj {
+			return ci > cj
+		}
+		return sources[i] < sources[j]
+	})
+
+	parts := make([]string, len(sources))
+	for i, source := range sources {
+		parts[i] = fmt.Sprintf("%s: %d", source, len(addresses[source]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// removeDuplicates removes duplicate strings from a slice
+func removeDuplicates(slice []string) []string {
+	seen := make(map[string]bool)
+	result := []string{}
+	for _, item := range slice {
+		if !seen[item] {
+			seen[item] = true
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// wildcardMask returns the Cisco wildcard (inverted) form of a netmask
+func wildcardMask(mask net.IPMask) string {
+	wildcard := make(net.IP, len(mask))
+	for i, b := range mask {
+		wildcard[i] = ^b
+	}
+	return wildcard.String()
+}
+
+// iosACLLine formats a single IP or CIDR as a Cisco IOS ACL permit entry
+func iosACLLine(entry string) string {
+	if !strings.Contains(entry, "/") {
+		return fmt.Sprintf("permit ip host %s any", entry)
+	}
+	_, ipnet, err := net.ParseCIDR(entry)
+	if err != nil {
+		return fmt.Sprintf("permit ip host %s any", entry)
+	}
+	if ones, bits := ipnet.Mask.Size(); ones == bits {
+		return fmt.Sprintf("permit ip host %s any", ipnet.IP)
+	}
+	return fmt.Sprintf("permit ip %s %s any", ipnet.IP, wildcardMask(ipnet.Mask))
+}
+
+// shellQuote quotes s for a POSIX shell if it is empty or has special characters
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789.,:/_+=-") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// netmaskLine formats an IP or CIDR as "address netmask", or as the bare
+// address for a single host
+func netmaskLine(entry string) string {
+	if !strings.Contains(entry, "/") {
+		return entry
+	}
+	_, ipnet, err := net.ParseCIDR(entry)
+	if err != nil {
+		return entry
+	}
+	if ones, bits := ipnet.Mask.Size(); ones == bits {
+		return ipnet.IP.String()
+	}
+	return ipnet.IP.String() + " " + net.IP(ipnet.Mask).String()
+}
+
+// checkWireGuardCompat parses every AllowedIPs token the way wg does, as an
+// IP address or an address/prefix, and reports the first one it would reject
+func checkWireGuardCompat(ips []string) error {
+	for _, token := range ips {
+		if _, err := netip.ParseAddr(token); err == nil {
+			continue
+		}
+		if _, err := netip.ParsePrefix(token); err == nil {
+			continue
+		}
+		return fmt.Errorf("WireGuard would reject AllowedIPs entry %q", token)
+	}
+	return nil
+}
+
+// writeJoined writes ips separated by sep without building the joined string,
+// so large lists stream straight into a buffered writer
+func writeJoined(w io.Writer, ips []string, sep string) error {
+	for i, ip := range ips {
+		if i > 0 {
+			if _, err := io.WriteString(w, sep); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(w, ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonAddress is one address of -format json
+type jsonAddress struct {
+	Address    string   `json:"address"`
+	Sources    []string `json:"sources,omitempty"`
+	ResolvedAt string   `json:"resolvedAt,omitempty"`
+}
+
+// jsonOutput is the document written by -format json
+type jsonOutput struct {
+	AllowedIPs   []jsonAddress `json:"allowedIPs"`
+	RefreshAfter int           `json:"refreshAfter,omitempty"`
+}
+
+// jsonGroupedOutput is the document written by -format json -group-by-host
+type jsonGroupedOutput struct {
+	Groups       []jsonGroup `json:"groups"`
+	RefreshAfter int         `json:"refreshAfter,omitempty"`
+}
+
+// jsonGroup is the addresses of one hostname, or the literal ones, with
+// -group-by-host
+type jsonGroup struct {
+	Hostname   string        `json:"hostname,omitempty"`
+	Static     bool          `json:"static,omitempty"`
+	AllowedIPs []jsonAddress `json:"allowedIPs"`
+}
+
+// writeJSON writes ips with the hostnames each was resolved from and, with
+// -include-timestamps, when the oldest of those lookups happened. With
+// -refresh-after it adds when to re-run, in seconds.
+func writeJSON(w io.Writer, ips []string, entries []entry) error {
+	byValue := make(map[string][]entry)
+	for _, e := range entries {
+		byValue[e.value] = append(byValue[e.value], e)
+	}
+
+	var addresses []jsonAddress
+	for _, ip := range ips {
+		address := jsonAddress{Address: ip}
+		var oldest time.Time
+		for _, e := range byValue[ip] {
+			if e.source == "" || e.source == e.value {
+				continue
+			}
+			if !slices.Contains(address.Sources, e.source) {
+				address.Sources = append(address.Sources, e.source)
+			}
+			if !e.resolvedAt.IsZero() && (oldest.IsZero() || e.resolvedAt.Before(oldest)) {
+				oldest = e.resolvedAt
+			}
+		}
+		if *includeTimestamps && !oldest.IsZero() {
+			address.ResolvedAt = oldest.UTC().Format(time.RFC3339)
+		}
+		addresses = append(addresses, address)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	refresh := suggestedRefresh()
+	if *groupByHost {
+		return encoder.Encode(jsonGroupedOutput{Groups: groupByHostname(addresses, byValue), RefreshAfter: refresh})
+	}
+	if addresses == nil {
+		addresses = []jsonAddress{}
+	}
+	return encoder.Encode(jsonOutput{AllowedIPs: addresses, RefreshAfter: refresh})
+}
+
+// writeDot writes a Graphviz digraph with an edge from each hostname to every
+// address it resolved to; an address shared by hostnames is a single node
+func writeDot(w io.Writer, ips []string, entries []entry) error {
+	included := make(map[string]bool)
+	for _, ip := range ips {
+		included[ip] = true
+	}
+
+	var hostnames []string
+	edges := make(map[string][]string)
+	for _, e := range entries {
+		if e.source == "" || e.source == e.value || !included[e.value] {
+			continue
+		}
+		if _, ok := edges[e.source]; !ok {
+			hostnames = append(hostnames, e.source)
+		}
+		if !slices.Contains(edges[e.source], e.value) {
+			edges[e.source] = append(edges[e.source], e.value)
+		}
+	}
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "digraph allowedips {")
+	fmt.Fprintln(out, "  rankdir=LR;")
+	for _, hostname := range hostnames {
+		fmt.Fprintf(out, "  %s [shape=ellipse];\n", strconv.Quote(hostname))
+	}
+	for _, ip := range ips {
+		fmt.Fprintf(out, "  %s [shape=box];\n", strconv.Quote(ip))
+	}
+	for _, hostname := range hostnames {
+		for _, ip := range edges[hostname] {
+			fmt.Fprintf(out, "  %s -> %s;\n", strconv.Quote(hostname), strconv.Quote(ip))
+		}
+	}
+	fmt.Fprintln(out, "}")
+	return out.Flush()
+}
+
+// suggestedRefresh returns the seconds until the earliest record looked up
+// this run expires, but at least -min-refresh, or 0 without -refresh-after or
+// if nothing was looked up
+func suggestedRefresh() int {
+	if !*refreshAfter {
+		return 0
+	}
+	ttl, ok := minTTL.min()
+	if !ok {
+		return 0
+	}
+	return max(ttl, int(minRefresh.Seconds()))
+}
+
+// groupByHostname groups addresses under each hostname they were resolved
+// from, hostnames sorted, followed by a static group of the literal ones. An
+// address from several hostnames, or also given literally, is in each group.
+func groupByHostname(addresses []jsonAddress, byValue map[string][]entry) []jsonGroup {
+	byHostname := make(map[string][]jsonAddress)
+	var static []jsonAddress
+	for _, address := range addresses {
+		seen := make(map[string]bool)
+		for _, e := range byValue[address.Address] {
+			if seen[e.source] {
+				continue
+			}
+			seen[e.source] = true
+			if e.source == "" {
+				static = append(static, address)
+			} else {
+				byHostname[e.source] = append(byHostname[e.source], address)
+			}
+		}
+	}
+
+	hostnames := make([]string, 0, len(byHostname))
+	for hostname := range byHostname {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+
+	groups := []jsonGroup{}
+	for _, hostname := range hostnames {
+		groups = append(groups, jsonGroup{Hostname: hostname, AllowedIPs: byHostname[hostname]})
+	}
+	if len(static) > 0 {
+		groups = append(groups, jsonGroup{Static: true, AllowedIPs: static})
+	}
+	return groups
+}
+
+// writeList writes the IP list to w in the given output format; entries
+// supply the provenance some formats include
+func writeList(w io.Writer, format string, ips []string, entries []entry) error {
+	switch format {
+	case "plain":
+		if len(ips) > 0 && *wrapWidth > 0 {
+			// Continuation lines are indented, each line but the last
+			// ending with the comma that separates it from the next
+			for i, run := range wrapIPs(ips, *wrapWidth, 0, 2, true) {
+				if i > 0 {
+					if _, err := io.WriteString(w, ",\n  "); err != nil {
+						return err
+					}
+				}
+				if err := writeJoined(w, run, ","); err != nil {
+					return err
+				}
+			}
+			_, err := io.WriteString(w, "\n")
+			return err
+		}
+		if len(ips) > 0 {
+			if err := writeJoined(w, ips, ","); err != nil {
+				return err
+			}
+			_, err := io.WriteString(w, "\n")
+			return err
+		}
+	case "ios-acl":
+		for _, ip := range ips {
+			if _, err := fmt.Fprintln(w, iosACLLine(ip)); err != nil {
+				return err
+			}
+		}
+	case "netmask":
+		for _, ip := range ips {
+			if _, err := fmt.Fprintln(w, netmaskLine(ip)); err != nil {
+				return err
+			}
+		}
+	case "json":
+		return writeJSON(w, ips, entries)
+	case "dot":
+		return writeDot(w, ips, entries)
+	case "wg-set":
+		_, err := fmt.Fprintf(w, "wg set %s peer %s allowed-ips %s\n", shellQuote(*wgInterface), shellQuote(*peerKey), shellQuote(strings.Join(ips, ",")))
+		return err
+	default:
+		return fmt.Errorf("unknown output format: %s", format)
+	}
+	return nil
+}
+
+// configSection is the line range of one [Section] in a wg-config
+type configSection struct {
+	name  string // section name without brackets, e.g. "Peer"
+	start int    // index of the header line
+	end   int    // index one past the last line of the section
+}
+
+// readLines reads a whole file into a slice of lines
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// parseSections splits wg-config lines into their [Section] blocks
+func parseSections(lines []string) []configSection {
+	var sections []configSection
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "[") || !strings.HasSuffix(trimmed, "]") {
+			continue
+		}
+		if len(sections) > 0 {
+			sections[len(sections)-1].end = i
+		}
+		name := strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+		sections = append(sections, configSection{name: name, start: i, end: len(lines)})
+	}
+	return sections
+}
+
+// configKeyValue splits a "Key = Value" wg-config line
+func configKeyValue(line string) (key, value string, ok bool) {
+	trimmed := strings.TrimSpace(line)
+	if strings.HasPrefix(trimmed, "#") {
+		return "", "", false
+	}
+	key, value, ok = strings.Cut(trimmed, "=")
+	if !ok {
+		return "", "", false
+	}
+	return strings.TrimSpace(key), strings.TrimSpace(value), true
+}
+
+// sectionValue returns the value of the first key line in a section
+func sectionValue(lines []string, section configSection, key string) (string, bool) {
+	for _, line := range lines[section.start+1 : section.end] {
+		k, v, ok := configKeyValue(line)
+		if ok && strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// endpointHost returns the host part of an Endpoint value (host:port)
+func endpointHost(endpoint string) string {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return endpoint
+	}
+	return host
+}
+
+// selectPeerByEndpoint finds the single [Peer] section whose Endpoint host matches
+func selectPeerByEndpoint(lines []string, sections []configSection, host string) (*configSection, error) {
+	var matches []configSection
+	for _, section := range sections {
+		if !strings.EqualFold(section.name, "Peer") {
+			continue
+		}
+		endpoint, ok := sectionValue(lines, section, "Endpoint")
+		if ok && strings.EqualFold(strings.TrimSuffix(endpointHost(endpoint), "."), strings.TrimSuffix(host, ".")) {
+			matches = append(matches, section)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no [Peer] has Endpoint host %s", host)
+	case 1:
+		return &matches[0], nil
+	default:
+		return nil, fmt.Errorf("%d [Peer] sections have Endpoint host %s", len(matches), host)
+	}
+}
+
+// rewriteConfig writes the wg-config lines to w with AllowedIPs replaced,
+// restricted to the given peer section if it is not nil
+func rewriteConfig(w io.Writer, lines []string, allowedIPs []string, peer *configSection) error {
+	const prefix = "AllowedIPs = "
+	targets := allowedIPsTargets(lines, peer)
+	runs := [][]string{allowedIPs}
+	if *wrapWidth > 0 {
+		if wrapped := wrapIPs(allowedIPs, *wrapWidth, len(prefix), len(prefix), false); len(wrapped) > 0 {
+			runs = wrapped
+		}
+	}
+
+	// With -wrap a peer gets several AllowedIPs lines, so once a section
+	// has had its list written its other AllowedIPs lines are dropped
+	sections := parseSections(lines)
+	written := make(map[int]bool)
+	for i, line := range lines {
+		if targets[i] {
+			section := sectionIndex(sections, i)
+			if *wrapWidth > 0 && written[section] {
+				continue
+			}
+			written[section] = true
+			for _, run := range runs {
+				if _, err := io.WriteString(w, prefix); err != nil {
+					return err
+				}
+				if err := writeJoined(w, run, ","); err != nil {
+					return err
+				}
+				if _, err := io.WriteString(w, "\n"); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sectionIndex returns the index of the section containing line i, or -1 if
+// it precedes the first section
+func sectionIndex(sections []configSection, i int) int {
+	for n, section := range sections {
+		if i >= section.start && i < section.end {
+			return n
+		}
+	}
+	return -1
+}
+
+// wrapIPs splits ips into runs that fit within width columns when joined with
+// commas, after a prefix of firstPrefix columns on the first line and prefix
+// columns on the others, and with a trailing comma on all but the last line
+// if trailingComma is set. A run always holds at least one address, so a
+// single long one may still overflow.
+func wrapIPs(ips []string, width, firstPrefix, prefix int, trailingComma bool) [][]string {
+	var runs [][]string
+	var run []string
+	used := firstPrefix
+	for _, ip := range ips {
+		length := used + len(ip)
+		if len(run) > 0 {
+			length++ // the comma before it
+		}
+		end := length
+		if trailingComma {
+			end++ // the comma after it, should the line break there
+		}
+		if len(run) > 0 && end > width {
+			runs = append(runs, run)
+			run = nil
+			length = prefix + len(ip)
+		}
+		run = append(run, ip)
+		used = length
+	}
+	if len(run) > 0 {
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// commentedAllowedIPs matches a commented-out AllowedIPs template line
+var commentedAllowedIPs = regexp.MustCompile(`^#\s*AllowedIPs\s*=`)
+
+// allowedIPsTargets returns the indices of the lines to replace with the new
+// AllowedIPs. With -uncomment-allowedips, a [Peer] whose only AllowedIPs is
+// commented out gets that line filled in instead.
+func allowedIPsTargets(lines []string, peer *configSection) map[int]bool {
+	targets := make(map[int]bool)
+	for i, line := range lines {
+		inPeer := peer == nil || (i > peer.start && i < peer.end)
+		if inPeer && strings.HasPrefix(strings.TrimSpace(line), "AllowedIPs") {
+			targets[i] = true
+		}
+	}
+	if !*uncommentAllowedIPs {
+		return targets
+	}
+
+	sections := parseSections(lines)
+	if peer != nil {
+		sections = []configSection{*peer}
+	}
+	for _, section := range sections {
+		if !strings.EqualFold(section.name, "Peer") {
+			continue
+		}
+		commented := -1
+		active := false
+		for i := section.start + 1; i < section.end; i++ {
+			if targets[i] {
+				active = true
+				break
+			}
+			if commented < 0 && commentedAllowedIPs.MatchString(strings.TrimSpace(lines[i])) {
+				commented = i
+			}
+		}
+		if !active && commented >= 0 {
+			targets[commented] = true
+		}
+	}
+	return targets
+}
+
+// runState is persisted in the -state-file between runs
+type runState struct {
+	// Warnings maps a failure key to the time it was last logged
+	Warnings map[string]time.Time `json:"warnings,omitempty"`
+	// LastSuccess describes the last successful run, for -since-last-success
+	LastSuccess *successRecord `json:"lastSuccess,omitempty"`
+	// KnownGood maps a lookup to its last successful answer
+	KnownGood map[string]knownAnswer `json:"knownGood,omitempty"`
+}
+
+// successRecord fingerprints the inputs of a successful run and keeps its
+// stdout so an unchanged run can replay it without resolving anything
+type successRecord struct {
+	Time        time.Time            `json:"time"`
+	InputSHA256 string               `json:"inputSha256"`
+	InputMtimes map[string]time.Time `json:"inputMtimes"`
+	Output      string               `json:"output,omitempty"`
+}
+
+// runInputs lists the files whose contents determine this run's output
+func runInputs(configFile, wgConfigFile string) ([]string, error) {
+	var inputs []string
+	if *fleetFile != "" {
+		fleet, err := loadFleet(*fleetFile)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, *fleetFile)
+		for _, t := range fleet.Tunnels {
+			inputs = append(inputs, t.AllowedFile, t.WGConfig, t.Output)
+		}
+		if *hostnameDenylist != "" {
+			inputs = append(inputs, *hostnameDenylist)
+		}
+		return inputs, nil
+	}
+	for _, path := range []string{configFile, wgConfigFile, *injectFile, *baselineFile, *hostnameDenylist, *templateConfig} {
+		if path != "" {
+			inputs = append(inputs, path)
+		}
+	}
+	return inputs, nil
+}
+
+// fingerprintInputs hashes the command line and the contents of the input
+// files, and records their modification times
+func fingerprintInputs(inputs []string) (string, map[string]time.Time, error) {
+	digest := sha256.New()
+	for _, arg := range os.Args[1:] {
+		fmt.Fprintf(digest, "%q\n", arg)
+	}
+	mtimes := make(map[string]time.Time)
+	for _, path := range inputs {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", nil, err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", nil, err
+		}
+		fmt.Fprintf(digest, "%q %d\n", path, len(data))
+		digest.Write(data)
+		mtimes[path] = info.ModTime()
+	}
+	return hex.EncodeToString(digest.Sum(nil)), mtimes, nil
+}
+
+// unchangedSinceSuccess reports whether the last successful run was within
+// -skip-window and saw exactly the same inputs
+func unchangedSinceSuccess(state *runState, inputs []string) bool {
+	last := state.LastSuccess
+	if last == nil || time.Since(last.Time) > *skipWindow {
+		return false
+	}
+	hash, mtimes, err := fingerprintInputs(inputs)
+	if err != nil || hash != last.InputSHA256 || len(mtimes) != len(last.InputMtimes) {
+		return false
+	}
+	for path, mtime := range mtimes {
+		if !mtime.Equal(last.InputMtimes[path]) {
+			return false
+		}
+	}
+	return true
+}
+
+// recordSuccess stores the fingerprint and stdout of a successful run
+func recordSuccess(state *runState, inputs []string, output *bytes.Buffer) {
+	hash, mtimes, err := fingerprintInputs(inputs)
+	if err != nil {
+		warn("Failed to fingerprint inputs for -since-last-success: %v", err)
+		return
+	}
+	state.LastSuccess = &successRecord{
+		Time:        time.Now(),
+		InputSHA256: hash,
+		InputMtimes: mtimes,
+		Output:      output.String(),
+	}
+	if err := saveState(*stateFile, state); err != nil {
+		errorExit("Failed to write state file: %v", err)
+	}
+}
+
+// loadState reads the state file, returning empty state if it does not exist yet
+func loadState(path string) (*runState, error) {
+	state := &runState{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return state, nil
+}
+
+// saveState writes the state file via a temporary file and rename
+func saveState(path string, state *runState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0600)
+}
+
+// writeFileAtomic replaces path with data via a temporary file and rename,
+// keeping the mode of an existing file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".wg-allowedips-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// failureLog logs resolution failures, optionally suppressing ones that were
+// already logged within the cooldown window on a previous run
+type failureLog struct {
+	mu        sync.Mutex
+	state     *runState
+	cooldown  time.Duration
+	now       time.Time
+	seen      map[string]bool
+	count     int // failures seen this run, logged or not
+	hostnames int // hostnames looked up this run
+}
+
+// expect adds n hostnames to the number looked up this run
+func (f *failureLog) expect(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hostnames += n
+}
+
+// overThreshold reports an error if more than -fail-threshold of this run's
+// hostnames failed to resolve
+func (f *failureLog) overThreshold() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.hostnames == 0 || float64(f.count)/float64(f.hostnames) <= *failThreshold {
+		return nil
+	}
+	return fmt.Errorf("%d of %d hostname lookup(s) failed, more than -fail-threshold %g", f.count, f.hostnames, *failThreshold)
+}
+
+// warn logs a failure identified by key unless it is still cooling down
+func (f *failureLog) warn(key string, format string, args ...interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.count++
+	if f.state == nil {
+		warn(format, args...)
+		return
+	}
+	f.seen[key] = true
+	if last, ok := f.state.Warnings[key]; ok && f.now.Sub(last) < f.cooldown {
+		return
+	}
+	warn(format, args...)
+	if f.state.Warnings == nil {
+		f.state.Warnings = make(map[string]time.Time)
+	}
+	f.state.Warnings[key] = f.now
+}
+
+// prune forgets failures that did not recur this run, so they log again if
+// they come back
+func (f *failureLog) prune() {
+	if f.state == nil {
+		return
+	}
+	for key := range f.state.Warnings {
+		if !f.seen[key] {
+			delete(f.state.Warnings, key)
+		}
+	}
+}
+
+// resolvedTotal counts the addresses resolved from hostnames this run
+var resolvedTotal atomic.Int64
+
+// outputDigest hashes everything this run writes as output, for -audit-log
+var outputDigest = sha256.New()
+
+// auditRecord is one line of the -audit-log
+type auditRecord struct {
+	Time         time.Time `json:"time"`
+	Input        string    `json:"input"`
+	InputSHA256  string    `json:"inputSha256"`
+	Resolved     int64     `json:"resolved"`
+	Failures     int       `json:"failures"`
+	OutputSHA256 string    `json:"outputSha256"`
+}
+
+// appendAudit appends a record of this run to the audit log. The record is a
+// single write to a file opened with O_APPEND, so overlapping runs do not
+// interleave their lines.
+func appendAudit(path, input string, failures *failureLog) {
+	data, err := os.ReadFile(input)
+	if err != nil {
+		errorExit("Failed to hash %s for the audit log: %v", input, err)
+	}
+	inputSum := sha256.Sum256(data)
+	record := auditRecord{
+		Time:         time.Now().UTC(),
+		Input:        input,
+		InputSHA256:  hex.EncodeToString(inputSum[:]),
+		Resolved:     resolvedTotal.Load(),
+		Failures:     failures.count,
+		OutputSHA256: hex.EncodeToString(outputDigest.Sum(nil)),
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		errorExit("Failed to encode audit record: %v", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		errorExit("Failed to open audit log: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		errorExit("Failed to write audit log: %v", err)
+	}
+}
+
+// invocationRecord captures how a run was invoked, for -record-invocation
+type invocationRecord struct {
+	Version   string            `json:"version"`
+	Args      []string          `json:"args"`
+	Options   map[string]string `json:"options"`
+	Arguments []string          `json:"arguments"`
+}
+
+// stageInvocation stages a JSON record of the tool version and the value of
+// every option, defaults included, so the run can be reproduced
+func stageInvocation(path string) error {
+	record := invocationRecord{
+		Version:   version,
+		Args:      os.Args[1:],
+		Options:   make(map[string]string),
+		Arguments: flag.Args(),
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		record.Options[f.Name] = f.Value.String()
+	})
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	return staged.stage(path, append(data, '\n'), 0644)
+}
+
+// stdout is where the output is printed. With -max-runtime it is held in
+// heldStdout until commitOutputs, so a run that times out prints nothing.
+var (
+	stdout     io.Writer = os.Stdout
+	heldStdout bytes.Buffer
+)
+
+// configDiffers is set when -diff-config found changes, so the run exits 1
+var configDiffers bool
+
+// runtimeGuard is held by whichever of commitOutputs and the -max-runtime
+// timer comes first, so a run is either aborted or finishes writing, not both
+var runtimeGuard sync.Mutex
+
+// limitRuntime aborts the run, discarding its output, once limit has passed
+func limitRuntime(limit time.Duration) {
+	stdout = &heldStdout
+	time.AfterFunc(limit, func() {
+		runtimeGuard.Lock()
+		staged.rollback()
+		progress.clear()
+		fmt.Fprintf(os.Stderr, colorRed+"ERROR: Exceeded -max-runtime %v"+colorReset+"\n", limit)
+		os.Exit(124)
+	})
+}
+
+// commitOutputs moves all staged output files into place and prints the
+// output held back for -max-runtime
+func commitOutputs() {
+	runtimeGuard.Lock()
+	if err := staged.commit(); err != nil {
+		errorExit("Failed to write output: %v", err)
+	}
+	if _, err := heldStdout.WriteTo(os.Stdout); err != nil {
+		errorExit("Error writing output: %v", err)
+	}
+}
+
+// saveRunState records failures seen this run into the state file, if any
+func saveRunState(state *runState, failures *failureLog) {
+	if state == nil {
+		return
+	}
+	failures.prune()
+	if *offlineFallback {
+		knownGood.mu.Lock()
+		state.KnownGood = knownGood.answers
+		knownGood.mu.Unlock()
+	}
+	if err := saveState(*stateFile, state); err != nil {
+		errorExit("Failed to write state file: %v", err)
+	}
+}
+
+// applyAllowedIPs sets the AllowedIPs of -peer on -interface to ips
+func applyAllowedIPs(ips []string) error {
+	output, err := exec.Command("wg", "set", *wgInterface, "peer", *peerKey, "allowed-ips", strings.Join(ips, ",")).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("wg set failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// watchDNS applies ips to the interface, then re-resolves the allowed file
+// every -watch-dns interval and re-applies it whenever the set changes. A
+// round that fails keeps the previous set. It never returns.
+func watchDNS(configFile, csvColumn string, state *runState, ips []string) {
+	if err := applyAllowedIPs(ips); err != nil {
+		errorExit("%v", err)
+	}
+	fmt.Fprintf(os.Stderr, "%s Applied %d AllowedIPs to %s\n", time.Now().Format(time.RFC3339), len(ips), *wgInterface)
+
+	for range time.Tick(*watchInterval) {
+		// Start each round with fresh lookups
+		lookupCache = &resolveCache{entries: make(map[string]*cachedLookup)}
+		failures := &failureLog{state: state, cooldown: *warningCooldown, now: time.Now(), seen: make(map[string]bool)}
+		_, next, err := buildAllowedIPs(configFile, csvColumn, failures)
+		saveRunState(state, failures)
+		if err == nil {
+			err = failures.overThreshold()
+		}
+		if err == nil && *compatCheck {
+			err = checkWireGuardCompat(next)
+		}
+		if err != nil {
+			warn("Keeping the previous AllowedIPs: %v", err)
+			continue
+		}
+
+		added, removed := subtractEntries(next, ips), subtractEntries(ips, next)
+		if len(added) == 0 && len(removed) == 0 {
+			verbosef("No DNS changes")
+			continue
+		}
+		if err := applyAllowedIPs(next); err != nil {
+			warn("Keeping the previous AllowedIPs: %v", err)
+			continue
+		}
+		progress.clear()
+		fmt.Fprintf(os.Stderr, "%s Applied %d AllowedIPs to %s: added %s, removed %s\n", time.Now().Format(time.RFC3339), len(next), *wgInterface, listOrNone(added), listOrNone(removed))
+		ips = next
+	}
+}
+
+// listOrNone joins ips with commas, or returns "none" if there are none
+func listOrNone(ips []string) string {
+	if len(ips) == 0 {
+		return "none"
+	}
+	return strings.Join(ips, ",")
+}
+
+// explainOrder prints to stderr why each entry of the sorted list precedes
+// the next one. By default the list is sorted as plain strings, so the reason
+// is the first differing character or one entry being a prefix of the other.
+// With -sort-by weight (weights not nil) it is the weight or, for equal
+// weights, the numeric address order.
+func explainOrder(ips []string, weights map[string]int) {
+	for i := 1; i < len(ips); i++ {
+		a, b := ips[i-1], ips[i]
+		if weights != nil {
+			if weights[a] != weights[b] {
+				fmt.Fprintf(os.Stderr, "%s < %s: weight %d > %d\n", a, b, weights[a], weights[b])
+			} else {
+				fmt.Fprintf(os.Stderr, "%s < %s: equal weight %d, lower address\n", a, b, weights[a])
+			}
+			continue
+		}
+		pos := 0
+		for pos < len(a) && pos < len(b) && a[pos] == b[pos] {
+			pos++
+		}
+		if pos == len(a) {
+			fmt.Fprintf(os.Stderr, "%s < %s: prefix of the latter\n", a, b)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s < %s: '%c' < '%c' at character %d\n", a, b, a[pos], b[pos], pos+1)
+		}
+	}
+}
+
+// entryWeights returns the highest weight given to each address
+func entryWeights(entries []entry) map[string]int {
+	weights := make(map[string]int)
+	for _, e := range entries {
+		if w, ok := weights[e.value]; !ok || e.weight > w {
+			weights[e.value] = e.weight
+		}
+	}
+	return weights
+}
+
+// sortByWeight orders ips by descending weight, breaking ties numerically.
+// This only changes the order; WireGuard itself ignores it.
+func sortByWeight(ips []string, weights map[string]int) {
+	sort.SliceStable(ips, func(i, j int) bool {
+		if weights[ips[i]] != weights[ips[j]] {
+			return weights[ips[i]] > weights[ips[j]]
+		}
+		return compareAddresses(ips[i], ips[j]) < 0
+	})
+}
+
+// compareAddresses orders IPs and CIDRs numerically by address and then
+// prefix length; anything else (kept hostnames) sorts after them by name
+func compareAddresses(a, b string) int {
+	pa, errA := netip.ParsePrefix(networkKey(a))
+	pb, errB := netip.ParsePrefix(networkKey(b))
+	switch {
+	case errA != nil && errB != nil:
+		return strings.Compare(a, b)
+	case errA != nil:
+		return 1
+	case errB != nil:
+		return -1
+	}
+	if c := pa.Addr().Compare(pb.Addr()); c != 0 {
+		return c
+	}
+	return pa.Bits() - pb.Bits()
+}
+
+// shuffleIPs puts a sorted list into a random order that is reproducible with
+// the same -seed
+func shuffleIPs(ips []string) {
+	seed := *shuffleSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	verbosef("Shuffling with -seed %d", seed)
+	rng := rand.New(rand.NewSource(seed))
+	rng.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+}
+
+// resolveAllowedFile parses and resolves an allowed file, or the given column
+// of a CSV file, with host bits masked but otherwise unordered and unreported
+func resolveAllowedFile(path, csvColumn string, failures *failureLog) ([]entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Config file does not exist: %s", path)
+	}
+	defer file.Close()
+
+	var entries []entry
+	if csvColumn != "" {
+		entries, err = parseCSV(file, csvColumn, failures)
+	} else {
+		entries, err = parseAllowed(file, failures)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return maskHostBits(entries), nil
+}
+
+// buildAllowedIPs parses and resolves an allowed file, or the given column of
+// a CSV file, returning every entry it resolved to and the sorted,
+// deduplicated AllowedIPs list
+func buildAllowedIPs(path, csvColumn string, failures *failureLog) ([]entry, []string, error) {
+	entries, err := resolveAllowedFile(path, csvColumn, failures)
+	if err != nil {
+		return nil, nil, err
+	}
+	if *verbose {
+		noteCovered(entries)
+		verbosef("Addresses by source: %s", countBySource(entries))
+	}
+
+	// Remove duplicates and sort
+	allIPs := removeDuplicates(entryValues(entries))
+	sort.Strings(allIPs)
+	var weights map[string]int
+	if *sortBy == "weight" {
+		weights = entryWeights(entries)
+		sortByWeight(allIPs, weights)
+	}
+	if *explainSort {
+		explainOrder(allIPs, weights)
+	}
+	if *shuffle {
+		shuffleIPs(allIPs)
+	}
+	return entries, allIPs, nil
+}
+
+// loadConfig reads a wg-config and selects the peer with the given Endpoint
+// host if one is set
+func loadConfig(path, endpoint string) ([]string, *configSection, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil, fmt.Errorf("WireGuard config file does not exist: %s", path)
+	}
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error reading WireGuard config file: %v", err)
+	}
+
+	var peer *configSection
+	if endpoint != "" {
+		peer, err = selectPeerByEndpoint(lines, parseSections(lines), endpoint)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return lines, peer, nil
+}
+
+// renderConfig writes the wg-config at path to w with AllowedIPs replaced,
+// limited to the peer with the given Endpoint host if one is set
+func renderConfig(w io.Writer, path string, allowedIPs []string, endpoint string) error {
+	lines, peer, err := loadConfig(path, endpoint)
+	if err != nil {
+		return err
+	}
+	if err := rewriteConfig(w, lines, allowedIPs, peer); err != nil {
+		return fmt.Errorf("Error writing output: %v", err)
+	}
+	return nil
+}
+
+// writeConfigDiff writes a unified diff from the wg-config at path to its
+// rewrite with allowedIPs, and reports whether they differ
+func writeConfigDiff(w io.Writer, path string, allowedIPs []string, endpoint string) (bool, error) {
+	original, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("Error reading WireGuard config file: %v", err)
+	}
+	var rewritten bytes.Buffer
+	if err := renderConfig(&rewritten, path, allowedIPs, endpoint); err != nil {
+		return false, err
+	}
+	return writeUnifiedDiff(w, splitLines(string(original)), splitLines(rewritten.String()), path, path+" (rewritten)")
+}
+
+// splitLines splits text into lines without their newlines
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// diffOp is one line of a diff: ' ' kept, '-' only in a, '+' only in b
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines returns the edit script turning a into b, from their longest
+// common subsequence
+func diffLines(a, b []string) []diffOp {
+	// common[i][j] is the length of the LCS of a[i:] and b[j:]
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || common[i+1][j] >= common[i][j+1]):
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	return ops
+}
+
+// writeUnifiedDiff writes the differences between a and b as a unified diff
+// and reports whether there were any
+func writeUnifiedDiff(w io.Writer, a, b []string, nameA, nameB string) (bool, error) {
+	ops := diffLines(a, b)
+	var changes []int
+	for n, op := range ops {
+		if op.kind != ' ' {
+			changes = append(changes, n)
+		}
+	}
+	if len(changes) == 0 {
+		return false, nil
+	}
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "--- %s\n+++ %s\n", nameA, nameB)
+	// lineA and lineB count the lines of a and b before ops[n]
+	lineA, lineB, n := 0, 0, 0
+	for c := 0; c < len(changes); {
+		start := max(changes[c]-diffContext, n)
+		end := changes[c] + 1
+		for c++; c < len(changes) && changes[c]-end < 2*diffContext; c++ {
+			end = changes[c] + 1
+		}
+		end = min(end+diffContext, len(ops))
+
+		for ; n < start; n++ {
+			lineA, lineB = lineA+1, lineB+1
+		}
+		countA, countB := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				countA++
+			}
+			if op.kind != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(lineA, countA), hunkRange(lineB, countB))
+		for ; n < end; n++ {
+			fmt.Fprintf(out, "%c%s\n", ops[n].kind, ops[n].line)
+			if ops[n].kind != '+' {
+				lineA++
+			}
+			if ops[n].kind != '-' {
+				lineB++
+			}
+		}
+	}
+	return true, out.Flush()
+}
+
+// hunkRange formats the "start,count" of a hunk that follows line before
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
+
+// configDNS returns the first DNS server listed on the [Interface] DNS line
+// of the wg-config at path; other entries there are search domains
+func configDNS(path string) (string, error) {
+	lines, _, err := loadConfig(path, "")
+	if err != nil {
+		return "", err
+	}
+	for _, section := range parseSections(lines) {
+		if !strings.EqualFold(section.name, "Interface") {
+			continue
+		}
+		value, ok := sectionValue(lines, section, "DNS")
+		if !ok {
+			break
+		}
+		for _, server := range strings.Split(value, ",") {
+			if server = strings.TrimSpace(server); net.ParseIP(server) != nil {
+				return server, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s has no DNS server in its [Interface] section", path)
+}
+
+// existingAllowedIPs returns the AllowedIPs entries currently in the wg-config
+// at path, limited to the peer with the given Endpoint host if one is set
+func existingAllowedIPs(path, endpoint string) ([]string, error) {
+	lines, peer, err := loadConfig(path, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var existing []string
+	for i, line := range lines {
+		if peer != nil && (i <= peer.start || i >= peer.end) {
+			continue
+		}
+		key, value, ok := configKeyValue(line)
+		if !ok || !strings.EqualFold(key, "AllowedIPs") {
+			continue
+		}
+		for _, ip := range strings.Split(value, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				existing = append(existing, ip)
+			}
+		}
+	}
+	return existing, nil
+}
+
+// checkOnlyGrow fails if rewriting the wg-config at path with allowedIPs
+// would drop any of its current AllowedIPs, for -only-grow
+func checkOnlyGrow(path, endpoint string, allowedIPs []string) error {
+	existing, err := existingAllowedIPs(path, endpoint)
+	if err != nil {
+		return err
+	}
+	if removed := uncoveredEntries(existing, allowedIPs); len(removed) > 0 {
+		return fmt.Errorf("Refusing to rewrite %s with -only-grow, it would remove AllowedIPs %s", path, strings.Join(removed, ","))
+	}
+	return nil
+}
+
+// uncoveredEntries returns the entries of existing whose addresses are not
+// all covered by some entry of ips, which may be the same network or a wider
+// one. Entries that are not IPs or CIDRs must appear in ips as they are.
+func uncoveredEntries(existing, ips []string) []string {
+	var prefixes []netip.Prefix
+	for _, ip := range ips {
+		if prefix, err := netip.ParsePrefix(networkKey(ip)); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	uncovered := []string{}
+	for _, e := range existing {
+		old, err := netip.ParsePrefix(networkKey(e))
+		if err != nil {
+			if !slices.Contains(ips, e) {
+				uncovered = append(uncovered, e)
+			}
+			continue
+		}
+		covered := false
+		for _, prefix := range prefixes {
+			if prefix.Bits() <= old.Bits() && prefix.Contains(old.Addr()) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			uncovered = append(uncovered, e)
+		}
+	}
+	return uncovered
+}
+
+// networkKey returns the masked CIDR an IP or CIDR entry denotes, so that
+// 10.0.0.1 and 10.0.0.1/32 compare equal
+func networkKey(s string) string {
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil {
+			if ip.To4() != nil {
+				return ip.String() + "/32"
+			}
+			return ip.String() + "/128"
+		}
+		return s
+	}
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		return ipnet.String()
+	}
+	return s
+}
+
+// subtractEntries returns the ips that do not denote the same network as
+// any entry in exclude
+func subtractEntries(ips, exclude []string) []string {
+	excluded := make(map[string]bool)
+	for _, e := range exclude {
+		excluded[networkKey(e)] = true
+	}
+	result := []string{}
+	for _, ip := range ips {
+		if !excluded[networkKey(ip)] {
+			result = append(result, ip)
+		}
+	}
+	return result
+}
+
+// staged holds the output files of this run until all of them are ready
+var staged = &stagedOutputs{}
+
+// stagedOutputs writes output files to temporaries next to their targets and
+// renames them all into place only once the whole run has succeeded, so a
+// failing run leaves every output untouched
+type stagedOutputs struct {
+	mu    sync.Mutex
+	files []stagedFile
+}
+
+type stagedFile struct {
+	tmp  string
+	path string
+}
+
+// stage writes data to a temporary file that commit will rename to path
+func (s *stagedOutputs) stage(path string, data []byte, perm os.FileMode) error {
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".wg-allowedips-*")
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.files = append(s.files, stagedFile{tmp: tmp.Name(), path: path})
+	outputDigest.Write(data)
+	s.mu.Unlock()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	return tmp.Close()
+}
+
+// commit renames every staged file into place
+func (s *stagedOutputs) commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.files {
+		if err := os.Rename(f.tmp, f.path); err != nil {
+			s.files = s.files[i:]
+			return err
+		}
+	}
+	s.files = nil
+	return nil
+}
+
+// rollback deletes all staged files that were not committed
+func (s *stagedOutputs) rollback() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.files {
+		os.Remove(f.tmp)
+	}
+	s.files = nil
+}
+
+// hostsLines returns "IP hostname" lines for every address resolved from a
+// hostname's A records, sorted by hostname and then address
+func hostsLines(entries []entry) []string {
+	var lines []string
+	for _, e := range entries {
+		if e.source == "" || e.record != "" || e.value == e.source {
+			continue
+		}
+		lines = append(lines, e.value+" "+e.source)
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		ipI, hostI, _ := strings.Cut(lines[i], " ")
+		ipJ, hostJ, _ := strings.Cut(lines[j], " ")
+		if hostI != hostJ {
+			return hostI < hostJ
+		}
+		return ipI < ipJ
+	})
+	return removeDuplicates(lines)
+}
+
+// injectBlock replaces the lines between "# BEGIN <marker>" and
+// "# END <marker>" in lines with block
+func injectBlock(lines []string, marker string, block []byte) ([]byte, error) {
+	begin, end := -1, -1
+	for i, line := range lines {
+		switch strings.TrimSpace(line) {
+		case "# BEGIN " + marker:
+			if begin >= 0 {
+				return nil, fmt.Errorf("line %d: duplicate BEGIN %s marker", i+1, marker)
+			}
+			begin = i
+		case "# END " + marker:
+			if begin < 0 {
+				return nil, fmt.Errorf("line %d: END %s marker before BEGIN", i+1, marker)
+			}
+			if end >= 0 {
+				return nil, fmt.Errorf("line %d: duplicate END %s marker", i+1, marker)
+			}
+			end = i
+		}
+	}
+	if begin < 0 || end < 0 {
+		return nil, fmt.Errorf("missing BEGIN/END %s markers", marker)
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines[:begin+1] {
+		buf.WriteString(line + "\n")
+	}
+	buf.Write(block)
+	for _, line := range lines[end:] {
+		buf.WriteString(line + "\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// injectInto stages the file at path with its marked block replaced by the
+// list in the given format, leaving the file untouched if nothing changed
+func injectInto(path, marker, format string, ips []string, entries []entry) error {
+	lines, err := readLines(path)
+	if err != nil {
+		return err
+	}
+	var block bytes.Buffer
+	if err := writeList(&block, format, ips, entries); err != nil {
+		return err
+	}
+	data, err := injectBlock(lines, marker, block.Bytes())
+	if err != nil {
+		return err
+	}
+	if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+	return staged.stage(path, data, 0644)
+}
+
+// templateData is what a -template-config template can use
+type templateData struct {
+	AllowedIPs     string              // comma-separated, as in a wg-config
+	AllowedIPsList []string            // the same addresses as a list
+	Resolved       map[string][]string // hostname to the addresses it resolved to
+	PublicKey      string              // -peer
+	Endpoint       string              // -endpoint
+}
+
+// renderTemplate executes the text/template at path to w. Besides the
+// standard functions, templates may use join (strings.Join).
+func renderTemplate(w io.Writer, path string, entries []entry, allowedIPs []string) error {
+	funcs := template.FuncMap{"join": strings.Join}
+	tmpl, err := template.New(filepath.Base(path)).Funcs(funcs).ParseFiles(path)
+	if err != nil {
+		return fmt.Errorf("Error reading template: %v", err)
+	}
+
+	data := templateData{
+		AllowedIPs:     strings.Join(allowedIPs, ","),
+		AllowedIPsList: allowedIPs,
+		Resolved:       make(map[string][]string),
+		PublicKey:      *peerKey,
+		Endpoint:       *endpoint,
+	}
+	for _, e := range entries {
+		if e.source != "" && e.value != e.source && !slices.Contains(data.Resolved[e.source], e.value) {
+			data.Resolved[e.source] = append(data.Resolved[e.source], e.value)
+		}
+	}
+
+	if err := tmpl.Execute(w, data); err != nil {
+		return fmt.Errorf("Error rendering template: %v", err)
+	}
+	return nil
+}
+
+// fleetTunnel is one tunnel to generate in -fleet mode
+type fleetTunnel struct {
+	Name         string `json:"name"`
+	AllowedFile  string `json:"allowedFile"`
+	WGConfig     string `json:"wgConfig"`
+	PeerEndpoint string `json:"peerEndpoint,omitempty"`
+	Output       string `json:"output"`
+}
+
+// fleetConfig is the -fleet JSON file
+type fleetConfig struct {
+	Tunnels []fleetTunnel `json:"tunnels"`
+}
+
+// loadFleet reads a fleet file; relative paths are taken relative to it
+func loadFleet(path string) (*fleetConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fleet := &fleetConfig{}
+	if err := json.Unmarshal(data, fleet); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(fleet.Tunnels) == 0 {
+		return nil, fmt.Errorf("%s: no tunnels defined", path)
+	}
+
+	dir := filepath.Dir(path)
+	relative := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	for i := range fleet.Tunnels {
+		t := &fleet.Tunnels[i]
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("tunnel #%d", i+1)
+		}
+		if t.AllowedFile == "" || t.WGConfig == "" || t.Output == "" {
+			return nil, fmt.Errorf("%s: %s needs allowedFile, wgConfig and output", path, t.Name)
+		}
+		t.AllowedFile = relative(t.AllowedFile)
+		t.WGConfig = relative(t.WGConfig)
+		t.Output = relative(t.Output)
+	}
+	return fleet, nil
+}
+
+// maxExpandBits limits expand to CIDRs of at most a /16's addresses
+const maxExpandBits = 16
+
+// expandEntry parses and resolves line as a single allowed file line, then
+// prints every address it covers, one per line: each address of a CIDR, the
+// addresses a hostname resolved to, or the IP itself
+func expandEntry(w io.Writer, line string) error {
+	failures := &failureLog{seen: make(map[string]bool)}
+	entries, err := parseLines([]sourceLine{{text: line, num: 1}}, failures)
+	if err != nil {
+		return err
+	}
+	if failures.count > 0 {
+		return fmt.Errorf("Could not expand %s", line)
+	}
+
+	out := bufio.NewWriter(w)
+	for _, e := range maskHostBits(entries) {
+		if e.source != "" && e.source != e.value {
+			verbosef("%s from %s", e.value, e.source)
+		}
+		if !strings.Contains(e.value, "/") {
+			fmt.Fprintln(out, e.value)
+			continue
+		}
+		prefix, err := netip.ParsePrefix(e.value)
+		if err != nil {
+			return err
+		}
+		if prefix.Addr().BitLen()-prefix.Bits() > maxExpandBits {
+			return fmt.Errorf("%s has too many addresses to expand, the limit is a /%d", e.value, prefix.Addr().BitLen()-maxExpandBits)
+		}
+		for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+			fmt.Fprintln(out, addr)
+		}
+	}
+	return out.Flush()
+}
+
+// runFleet generates every tunnel's config concurrently, sharing the lookup
+// cache, and stages the outputs once all of them succeeded
+func runFleet(fleet *fleetConfig, failures *failureLog) error {
+	outputs := make([]bytes.Buffer, len(fleet.Tunnels))
+	errs := make([]error, len(fleet.Tunnels))
+	sem := make(chan struct{}, max(*concurrency, 1))
+	var wg sync.WaitGroup
+
+	for i, t := range fleet.Tunnels {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			_, allIPs, err := buildAllowedIPs(t.AllowedFile, "", failures)
+			if err == nil && *compatCheck {
+				err = checkWireGuardCompat(allIPs)
+			}
+			if err == nil && *onlyGrow {
+				err = checkOnlyGrow(t.WGConfig, t.PeerEndpoint, allIPs)
+			}
+			if err == nil {
+				err = renderConfig(&outputs[i], t.WGConfig, allIPs, t.PeerEndpoint)
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %v", t.Name, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	for i, t := range fleet.Tunnels {
+		if err := staged.stage(t.Output, outputs[i].Bytes(), 0600); err != nil {
+			return fmt.Errorf("%s: %v", t.Name, err)
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] <allowed-file> [wg-config]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] -csv <file.csv> [wg-config]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] -fleet <fleet.json>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] expand <entry>\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if *maxRuntime < 0 {
+		errorExit("-max-runtime must be a positive duration")
+	}
+	if *maxRuntime > 0 {
+		if *watchInterval > 0 {
+			errorExit("-max-runtime cannot be used with -watch-dns")
+		}
+		limitRuntime(*maxRuntime)
+	}
+
+	expand := flag.Arg(0) == "expand"
+	if expand {
+		if flag.NArg() < 2 || *fleetFile != "" || *csvFile != "" {
+			usage()
+		}
+	} else if *fleetFile != "" {
+		if flag.NArg() != 0 {
+			usage()
+		}
+	} else if *csvFile != "" {
+		if flag.NArg() > 1 {
+			usage()
+		}
+	} else if flag.NArg() < 1 || flag.NArg() > 2 {
+		usage()
+	}
+
+	configFile := flag.Arg(0)
+	var wgConfigFile string
+	if flag.NArg() == 2 && !expand {
+		wgConfigFile = flag.Arg(1)
+	}
+	if *csvFile != "" {
+		// The CSV takes the place of the allowed file
+		configFile = *csvFile
+		wgConfigFile = flag.Arg(0)
+	}
+
+	switch *outputFormat {
+	case "plain", "ios-acl", "netmask", "json", "dot":
+	case "wg-set":
+		if *peerKey == "" || *wgInterface == "" {
+			errorExit("-format wg-set requires -peer and -interface")
+		}
+	default:
+		errorExit("Unknown output format: %s", *outputFormat)
+	}
+	if *offline && (*validateDNS || *dnsConsistency != "") {
+		errorExit("-offline cannot be used with -validate-dns or -check-dns-consistency")
+	}
+	if *includeTimestamps && *outputFormat != "json" {
+		errorExit("-include-timestamps requires -format json")
+	}
+	if *refreshAfter && *outputFormat != "json" {
+		errorExit("-refresh-after requires -format json")
+	}
+	if *groupByHost && *outputFormat != "json" {
+		errorExit("-group-by-host requires -format json")
+	}
+	if wgConfigFile != "" && *outputFormat != "plain" && !*subtractExisting {
+		errorExit("-format cannot be used together with a wg-config")
+	}
+	if *subtractExisting && wgConfigFile == "" {
+		errorExit("-subtract-existing requires a wg-config")
+	}
+	if *peerEndpoint != "" && wgConfigFile == "" {
+		errorExit("-peer-endpoint requires a wg-config")
+	}
+	if *keepHostnames && ((wgConfigFile != "" && !*subtractExisting) || *fleetFile != "") {
+		errorExit("-keep-hostnames-alongside only works for list output; WireGuard does not accept hostnames")
+	}
+	if *keepHostnames && *outputFormat != "plain" && *outputFormat != "json" {
+		errorExit("-keep-hostnames-alongside only works with -format plain or json")
+	}
+	if *injectFile != "" && wgConfigFile != "" && !*subtractExisting {
+		errorExit("-inject-into cannot be used together with a wg-config")
+	}
+	switch *sortBy {
+	case "address", "weight":
+	default:
+		errorExit("Unknown -sort-by: %s", *sortBy)
+	}
+	if *shuffle && *sortBy != "address" {
+		errorExit("-shuffle cannot be used with -sort-by")
+	}
+	if *explainSort && *shuffle {
+		errorExit("-explain-sort cannot be used with -shuffle")
+	}
+	if *baselineFile != "" && ((wgConfigFile != "" && !*subtractExisting) || *fleetFile != "") {
+		errorExit("-baseline only works for list output")
+	}
+	if *templateConfig != "" && (wgConfigFile != "" || *fleetFile != "" || *injectFile != "") {
+		errorExit("-template-config cannot be used with a wg-config, -fleet or -inject-into")
+	}
+	if *templateConfig != "" && *outputFormat != "plain" {
+		errorExit("-template-config renders a wg-config, so it cannot be used with -format")
+	}
+	if *watchInterval > 0 {
+		if *peerKey == "" || *wgInterface == "" {
+			errorExit("-watch-dns requires -peer and -interface")
+		}
+		if wgConfigFile != "" || *fleetFile != "" || *templateConfig != "" || *injectFile != "" || *emitHosts != "" || *baselineFile != "" || *validateDNS || *shuffle || *sinceLastSuccess {
+			errorExit("-watch-dns only applies the allowed file to -interface and cannot be combined with other outputs")
+		}
+		if *offline {
+			errorExit("-watch-dns cannot be used with -offline, it runs wg set")
+		}
+	} else if *watchInterval < 0 {
+		errorExit("-watch-dns must be a positive interval")
+	}
+	if *diffConfig && (wgConfigFile == "" || *subtractExisting || *injectFile != "" || *sinceLastSuccess) {
+		errorExit("-diff-config requires a wg-config to rewrite and cannot be used with -subtract-existing, -inject-into or -since-last-success")
+	}
+	if *onlyGrow && ((wgConfigFile == "" && *fleetFile == "") || *subtractExisting) {
+		errorExit("-only-grow requires a wg-config or -fleet to rewrite and cannot be used with -subtract-existing")
+	}
+	if *wrapWidth < 0 {
+		errorExit("-wrap must be a positive width")
+	}
+	if *wrapWidth > 0 && (*outputFormat != "plain" || *templateConfig != "") {
+		errorExit("-wrap only applies to plain output and wg-config rewriting")
+	}
+	if *failThreshold < 0 || *failThreshold > 1 {
+		errorExit("-fail-threshold must be between 0 and 1")
+	}
+	if *subnetBits < 0 || *subnetBits > 32 {
+		errorExit("-subnet-bits must be between 0 and 32")
+	}
+	if *offlineFallback && *stateFile == "" {
+		errorExit("-offline-fallback requires -state-file")
+	}
+	if *sinceLastSuccess && *stateFile == "" {
+		errorExit("-since-last-success requires -state-file")
+	}
+	if *emitHosts != "" && *fleetFile != "" {
+		errorExit("-emit-hosts cannot be used with -fleet")
+	}
+	if *fleetFile != "" && (*injectFile != "" || *outputFormat != "plain") {
+		errorExit("-fleet writes wg-configs, so it cannot be used with -inject-into or -format")
+	}
+	if *validateDNS && *fleetFile != "" {
+		errorExit("-validate-dns cannot be used with -fleet")
+	}
+	if *dedupeWarnings && *stateFile == "" {
+		errorExit("-dedupe-warnings requires -state-file")
+	}
+
+	if *hostnameDenylist != "" {
+		var err error
+		deniedHostnames, err = loadDenylist(*hostnameDenylist)
+		if err != nil {
+			errorExit("Failed to read hostname denylist: %v", err)
+		}
+	}
+	if *dnsConsistency != "" {
+		for _, server := range strings.Split(*dnsConsistency, ",") {
+			server = strings.TrimSpace(server)
+			if net.ParseIP(server) == nil && !isValidHostname(server) {
+				errorExit("Invalid resolver in -check-dns-consistency: %s", server)
+			}
+			consistencyResolvers = append(consistencyResolvers, server)
+		}
+		if len(consistencyResolvers) < 2 {
+			errorExit("-check-dns-consistency needs at least two resolvers")
+		}
+	}
+	if *useConfigDNS {
+		if wgConfigFile == "" {
+			errorExit("-use-config-dns requires a wg-config")
+		}
+		var err error
+		defaultServer, err = configDNS(wgConfigFile)
+		if err != nil {
+			errorExit("%v", err)
+		}
+		verbosef("Resolving through %s from the wg-config", defaultServer)
+	}
+	if *entryRegex != "" {
+		var err error
+		entryPattern, err = regexp.Compile(*entryRegex)
+		if err != nil {
+			errorExit("Invalid -entry-regex: %v", err)
+		}
+	}
+	if expand {
+		// The entry may be followed by its options as separate arguments
+		if err := expandEntry(stdout, strings.Join(flag.Args()[1:], " ")); err != nil {
+			errorExit("%v", err)
+		}
+		commitOutputs()
+		return
+	}
+
+	progress.enabled = *showProgress && !*quiet && isTerminal(os.Stderr)
+	defer progress.clear()
+
+	var state *runState
+	if *stateFile != "" {
+		var err error
+		state, err = loadState(*stateFile)
+		if err != nil {
+			errorExit("Failed to read state file: %v", err)
+		}
+	}
+	if state != nil && state.KnownGood != nil {
+		knownGood.answers = state.KnownGood
+	}
+	failures := &failureLog{cooldown: *warningCooldown, now: time.Now(), seen: make(map[string]bool)}
+	if *dedupeWarnings && !*validateDNS {
+		failures.state = state
+	}
+
+	if *diffConfig {
+		// Deferred first so it runs after the other deferred steps
+		defer func() {
+			if configDiffers {
+				os.Exit(1)
+			}
+		}()
+	}
+
+	// stdoutCopy keeps what this run printed, for -since-last-success to replay
+	var stdoutCopy bytes.Buffer
+	if *sinceLastSuccess {
+		inputs, err := runInputs(configFile, wgConfigFile)
+		if err != nil {
+			errorExit("%v", err)
+		}
+		if unchangedSinceSuccess(state, inputs) {
+			verbosef("Inputs unchanged since the last successful run, skipping")
+			io.WriteString(stdout, state.LastSuccess.Output)
+			commitOutputs()
+			return
+		}
+		defer recordSuccess(state, inputs, &stdoutCopy)
+	}
+	if *auditLog != "" {
+		input := configFile
+		if *fleetFile != "" {
+			input = *fleetFile
+		}
+		// Only successful runs return from main, so only they are recorded
+		defer appendAudit(*auditLog, input, failures)
+	}
+	if *recordInvocation != "" {
+		if err := stageInvocation(*recordInvocation); err != nil {
+			errorExit("Failed to record invocation: %v", err)
+		}
+	}
+
+	if *fleetFile != "" {
+		fleet, err := loadFleet(*fleetFile)
+		if err != nil {
+			errorExit("Failed to read fleet file: %v", err)
+		}
+		var allowedFiles []string
+		for _, t := range fleet.Tunnels {
+			allowedFiles = append(allowedFiles, t.AllowedFile)
+		}
+		if err := screenAllowedFiles(allowedFiles...); err != nil {
+			errorExit("%v", err)
+		}
+		if err := runFleet(fleet, failures); err != nil {
+			errorExit("%v", err)
+		}
+		saveRunState(state, failures)
+		if err := failures.overThreshold(); err != nil {
+			errorExit("%v", err)
+		}
+		commitOutputs()
+		return
+	}
+
+	csvColumn := ""
+	if *csvFile != "" {
+		csvColumn = *csvColumnName
+	}
+	if *baselineFile != "" {
+		// The allowed file itself is screened as it is parsed
+		if err := screenAllowedFiles(*baselineFile); err != nil {
+			errorExit("Baseline %v", err)
+		}
+	}
+	entries, allIPs, err := buildAllowedIPs(configFile, csvColumn, failures)
+	if err != nil {
+		errorExit("%v", err)
+	}
+	saveRunState(state, failures)
+	if err := failures.overThreshold(); err != nil {
+		errorExit("%v", err)
+	}
+
+	if *validateDNS {
+		if failures.count > 0 {
+			errorExit("%d hostname lookup(s) failed", failures.count)
+		}
+		commitOutputs()
+		return
+	}
+
+	if *watchInterval > 0 {
+		if *compatCheck {
+			if err := checkWireGuardCompat(allIPs); err != nil {
+				errorExit("%v", err)
+			}
+		}
+		commitOutputs()
+		watchDNS(configFile, csvColumn, state, allIPs)
+	}
+
+	if *emitHosts != "" {
+		var hosts bytes.Buffer
+		for _, line := range hostsLines(entries) {
+			hosts.WriteString(line + "\n")
+		}
+		if err := staged.stage(*emitHosts, hosts.Bytes(), 0644); err != nil {
+			errorExit("Failed to write %s: %v", *emitHosts, err)
+		}
+	}
+
+	if *baselineFile != "" {
+		// Only the baseline's addresses matter, not their order or sources
+		baseline, err := resolveAllowedFile(*baselineFile, "", failures)
+		if err != nil {
+			errorExit("Baseline %s: %v", *baselineFile, err)
+		}
+		allIPs = subtractEntries(allIPs, removeDuplicates(entryValues(baseline)))
+	}
+
+	if *subtractExisting {
+		existing, err := existingAllowedIPs(wgConfigFile, *peerEndpoint)
+		if err != nil {
+			errorExit("%v", err)
+		}
+		// Only the entries new to the wg-config are output, as a list
+		allIPs = subtractEntries(allIPs, existing)
+		wgConfigFile = ""
+	}
+
+	if *compatCheck {
+		if err := checkWireGuardCompat(allIPs); err != nil {
+			errorExit("%v", err)
+		}
+	}
+
+	if *onlyGrow {
+		if err := checkOnlyGrow(wgConfigFile, *peerEndpoint, allIPs); err != nil {
+			errorExit("%v", err)
+		}
+	}
+
+	if *injectFile != "" {
+		if err := injectInto(*injectFile, *injectMarker, *outputFormat, allIPs, entries); err != nil {
+			errorExit("Failed to inject into %s: %v", *injectFile, err)
+		}
+		commitOutputs()
+		return
+	}
+
+	// Output mode depends on whether wg-config was provided
+	writers := []io.Writer{stdout, outputDigest}
+	if *sinceLastSuccess {
+		// Only kept in memory when it may be replayed
+		writers = append(writers, &stdoutCopy)
+	}
+	out := bufio.NewWriter(io.MultiWriter(writers...))
+	if *templateConfig != "" {
+		// Render a whole wg-config from the template
+		if err := renderTemplate(out, *templateConfig, entries, allIPs); err != nil {
+			errorExit("%v", err)
+		}
+	} else if wgConfigFile == "" {
+		// Just output the list in the requested format
+		if err := writeList(out, *outputFormat, allIPs, entries); err != nil {
+			errorExit("Error writing output: %v", err)
+		}
+	} else if *diffConfig {
+		// Show how the wg-config would change instead of the result
+		differs, err := writeConfigDiff(out, wgConfigFile, allIPs, *peerEndpoint)
+		if err != nil {
+			errorExit("%v", err)
+		}
+		configDiffers = differs
+	} else {
+		// Read and output wg-config with AllowedIPs replaced
+		if err := renderConfig(out, wgConfigFile, allIPs, *peerEndpoint); err != nil {
+			errorExit("%v", err)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		errorExit("Error writing output: %v", err)
+	}
+	commitOutputs()
+}
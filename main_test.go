@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden files in testdata")
+
+// fakeAnswers are the "dig +short" answers of the fake resolver, keyed by
+// the query with any @server in front, e.g. "MX example.com"
+var fakeAnswers = map[string]string{
+	"app.example.com":                 "10.1.0.2\n10.1.0.1",
+	"cdn.example.com":                 "edge.example.net.\n203.0.113.11\n203.0.113.10\n198.51.100.1",
+	"TXT service.example.com":         `"10.9.0.0/28, 10.9.0." "1"`,
+	"MX example.com":                  "20 mx2.example.com.\n10 mx1.example.com.",
+	"mx1.example.com":                 "198.51.100.25",
+	"mx2.example.com":                 "198.51.100.26",
+	"@10.0.0.53 internal.example.com": "10.53.0.1",
+}
+
+// useFakeResolver answers every lookup from fakeAnswers, after a random
+// delay so concurrent lookups finish in a different order on every run, and
+// fails the test on any query it has no answer for
+func useFakeResolver(t *testing.T) {
+	t.Helper()
+	var mu sync.Mutex
+	var unexpected []string
+	saved := runDig
+	runDig = func(args ...string) ([]byte, error) {
+		var query []string
+		for _, arg := range args {
+			if !strings.HasPrefix(arg, "+") {
+				query = append(query, arg)
+			}
+		}
+		key := strings.Join(query, " ")
+		time.Sleep(time.Duration(rand.IntN(500)) * time.Microsecond)
+		answer, ok := fakeAnswers[key]
+		if !ok {
+			mu.Lock()
+			unexpected = append(unexpected, key)
+			mu.Unlock()
+			return nil, fmt.Errorf("fake resolver has no answer for %q", key)
+		}
+		return []byte(answer + "\n"), nil
+	}
+	*quiet = true
+	t.Cleanup(func() {
+		runDig = saved
+		*quiet = false
+		lookupCache = &resolveCache{entries: make(map[string]*cachedLookup)}
+		if len(unexpected) > 0 {
+			t.Errorf("unexpected lookups: %s", strings.Join(unexpected, ", "))
+		}
+	})
+}
+
+// newRun resets the per-run state a fresh process would start with
+func newRun() *failureLog {
+	lookupCache = &resolveCache{entries: make(map[string]*cachedLookup)}
+	return &failureLog{seen: make(map[string]bool)}
+}
+
+// checkGolden compares got with the golden file, or rewrites it with -update
+func checkGolden(t *testing.T, golden string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", golden)
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s:\n--- got\n%s--- want\n%s", path, got, want)
+	}
+}
+
+// goldenRuns is how many times each golden test runs the pipeline, so that
+// output depending on lookup timing or map order shows up as a mismatch
+const goldenRuns = 10
+
+func TestGoldenList(t *testing.T) {
+	useFakeResolver(t)
+	for run := 0; run < goldenRuns; run++ {
+		failures := newRun()
+		entries, ips, err := buildAllowedIPs("testdata/allowed.txt", "", failures)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failures.count > 0 {
+			t.Fatalf("%d lookup(s) failed", failures.count)
+		}
+		for _, format := range []string{"plain", "json", "dot"} {
+			var out bytes.Buffer
+			if err := writeList(&out, format, ips, entries); err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, "allowed."+format+".golden", out.Bytes())
+		}
+	}
+}
+
+func TestGoldenConfig(t *testing.T) {
+	useFakeResolver(t)
+	lines, err := readLines("testdata/wg.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for run := 0; run < goldenRuns; run++ {
+		_, ips, err := buildAllowedIPs("testdata/allowed.txt", "", newRun())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := rewriteConfig(&out, lines, ips, nil); err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, "allowed.conf.golden", out.Bytes())
+	}
+}
+
+func TestGoldenFleet(t *testing.T) {
+	useFakeResolver(t)
+	saved := *concurrency
+	t.Cleanup(func() { *concurrency = saved })
+
+	for _, n := range []int{1, 8} {
+		*concurrency = n
+		for run := 0; run < goldenRuns; run++ {
+			dir := t.TempDir()
+			fleet := &fleetConfig{}
+			// Several tunnels per file so they race for the shared lookups
+			for i := 0; i < 4; i++ {
+				for _, name := range []string{"allowed", "second"} {
+					fleet.Tunnels = append(fleet.Tunnels, fleetTunnel{
+						Name:        fmt.Sprintf("%s-%d", name, i),
+						AllowedFile: "testdata/" + name + ".txt",
+						WGConfig:    "testdata/wg.conf",
+						Output:      filepath.Join(dir, fmt.Sprintf("%s-%d.conf", name, i)),
+					})
+				}
+			}
+			if err := runFleet(fleet, newRun()); err != nil {
+				t.Fatal(err)
+			}
+			if err := staged.commit(); err != nil {
+				t.Fatal(err)
+			}
+			for _, tunnel := range fleet.Tunnels {
+				got, err := os.ReadFile(tunnel.Output)
+				if err != nil {
+					t.Fatal(err)
+				}
+				name, _, _ := strings.Cut(tunnel.Name, "-")
+				checkGolden(t, name+".conf.golden", got)
+			}
+		}
+	}
+}
+
+func TestWildcardMask(t *testing.T) {
+	tests := []struct {
+		ones int
+		want string
+	}{
+		{32, "0.0.0.0"},
+		{31, "0.0.0.1"},
+		{24, "0.0.0.255"},
+		{0, "255.255.255.255"},
+	}
+	for _, tt := range tests {
+		if got := wildcardMask(net.CIDRMask(tt.ones, 32)); got != tt.want {
+			t.Errorf("wildcardMask(/%d) = %q, want %q", tt.ones, got, tt.want)
+		}
+	}
+}
+
+func TestIOSACLLine(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  string
+	}{
+		{"10.0.0.1", "permit ip host 10.0.0.1 any"},
+		{"10.0.0.1/32", "permit ip host 10.0.0.1 any"},
+		{"10.0.0.0/31", "permit ip 10.0.0.0 0.0.0.1 any"},
+		{"10.0.0.0/24", "permit ip 10.0.0.0 0.0.0.255 any"},
+		{"0.0.0.0/0", "permit ip 0.0.0.0 255.255.255.255 any"},
+	}
+	for _, tt := range tests {
+		if got := iosACLLine(tt.entry); got != tt.want {
+			t.Errorf("iosACLLine(%q) = %q, want %q", tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestNetmaskLine(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  string
+	}{
+		{"10.0.0.1", "10.0.0.1"},
+		{"10.0.0.1/32", "10.0.0.1"},
+		{"10.0.0.0/31", "10.0.0.0 255.255.255.254"},
+		{"10.0.0.0/24", "10.0.0.0 255.255.255.0"},
+		{"0.0.0.0/0", "0.0.0.0 0.0.0.0"},
+	}
+	for _, tt := range tests {
+		if got := netmaskLine(tt.entry); got != tt.want {
+			t.Errorf("netmaskLine(%q) = %q, want %q", tt.entry, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkRewriteConfig rewrites a peer with every address of a /16, the
+// size of list writeJoined streams instead of joining
+func BenchmarkRewriteConfig(b *testing.B) {
+	prefix := netip.MustParsePrefix("10.0.0.0/16")
+	var ips []string
+	for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+		ips = append(ips, addr.String())
+	}
+	lines := []string{"[Interface]", "PrivateKey = key", "", "[Peer]", "PublicKey = peer", "AllowedIPs = 0.0.0.0/0"}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := rewriteConfig(io.Discard, lines, ips, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestUncoveredEntries(t *testing.T) {
+	tests := []struct {
+		existing []string
+		ips      []string
+		want     []string
+	}{
+		{[]string{"10.0.0.5"}, []string{"10.0.0.0/24"}, []string{}},
+		{[]string{"10.0.0.5/32"}, []string{"10.0.0.5"}, []string{}},
+		{[]string{"10.2.0.0/16"}, []string{"10.2.0.0/17"}, []string{"10.2.0.0/16"}},
+		{[]string{"10.0.0.5", "192.168.1.0/24"}, []string{"10.0.0.0/8"}, []string{"192.168.1.0/24"}},
+		{[]string{"0.0.0.0/0"}, []string{"0.0.0.0/0"}, []string{}},
+	}
+	for _, tt := range tests {
+		if got := uncoveredEntries(tt.existing, tt.ips); !slices.Equal(got, tt.want) {
+			t.Errorf("uncoveredEntries(%v, %v) = %v, want %v", tt.existing, tt.ips, got, tt.want)
+		}
+	}
+}